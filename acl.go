@@ -0,0 +1,191 @@
+package socks
+
+import (
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// ACL is the access control list about the connect target.
+// A rule can be an IP address, a CIDR, a FQDN or a wildcard
+// domain like "*.example.com", with an optional port like
+// "example.com:443" or "[::1]:22". Deny rules are checked
+// first, if Allow is not empty, the target must match one
+// of the allow rules.
+type ACL struct {
+	Allow []string `json:"allow,omitempty"`
+	Deny  []string `json:"deny,omitempty"`
+}
+
+type aclRule struct {
+	ipNet    *net.IPNet
+	domain   string
+	wildcard bool
+	port     uint16 // 0 is any port
+}
+
+type acl struct {
+	allow []*aclRule
+	deny  []*aclRule
+}
+
+func (a *ACL) compile() (*acl, error) {
+	if a == nil {
+		return nil, nil
+	}
+	c := acl{}
+	for _, rule := range a.Allow {
+		r, err := parseACLRule(rule)
+		if err != nil {
+			return nil, err
+		}
+		c.allow = append(c.allow, r)
+	}
+	for _, rule := range a.Deny {
+		r, err := parseACLRule(rule)
+		if err != nil {
+			return nil, err
+		}
+		c.deny = append(c.deny, r)
+	}
+	return &c, nil
+}
+
+func parseACLRule(rule string) (*aclRule, error) {
+	r := aclRule{}
+	host := rule
+	// CIDR with port is not supported, so only split
+	// the port when the rule is not a CIDR
+	if !strings.Contains(rule, "/") {
+		h, p, err := net.SplitHostPort(rule)
+		if err == nil {
+			port, err := strconv.ParseUint(p, 10, 16)
+			if err != nil {
+				return nil, errors.Errorf("invalid port in acl rule \"%s\"", rule)
+			}
+			host = h
+			r.port = uint16(port)
+		}
+	}
+	if host == "" {
+		return nil, errors.Errorf("empty host in acl rule \"%s\"", rule)
+	}
+	if strings.Contains(host, "/") {
+		_, ipNet, err := net.ParseCIDR(host)
+		if err != nil {
+			return nil, errors.Errorf("invalid CIDR in acl rule \"%s\"", rule)
+		}
+		r.ipNet = ipNet
+		return &r, nil
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		bits := net.IPv6len * 8
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+			bits = net.IPv4len * 8
+		}
+		r.ipNet = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+		return &r, nil
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if strings.HasPrefix(host, "*.") {
+		r.wildcard = true
+		host = host[1:] // keep "."
+	}
+	r.domain = host
+	return &r, nil
+}
+
+// match is used to check the target matches the rule, host
+// can be an IP address or a FQDN, ip is the resolved IP address
+// of the FQDN, it can be nil if the FQDN is not resolved.
+func (r *aclRule) match(host string, ip net.IP, port uint16) bool {
+	if r.port != 0 && r.port != port {
+		return false
+	}
+	if r.ipNet != nil {
+		if ip == nil {
+			ip = net.ParseIP(host)
+		}
+		return ip != nil && r.ipNet.Contains(ip)
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if r.wildcard {
+		return strings.HasSuffix(host, r.domain)
+	}
+	return host == r.domain
+}
+
+// denied is used to check the target matches one of the deny rules.
+func (a *acl) denied(host string, ip net.IP, port uint16) bool {
+	if a == nil {
+		return false
+	}
+	for _, r := range a.deny {
+		if r.match(host, ip, port) {
+			return true
+		}
+	}
+	return false
+}
+
+// hasIPRules is used to check the acl has the rules about IP address.
+func (a *acl) hasIPRules() bool {
+	if a == nil {
+		return false
+	}
+	for _, r := range append(a.allow[:len(a.allow):len(a.allow)], a.deny...) {
+		if r.ipNet != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// allowed is used to check the connect target is allowed, a FQDN
+// target should be checked with each resolved IP address, so rules
+// about IP address can also be applied to it.
+func (a *acl) allowed(host string, ip net.IP, port uint16) bool {
+	if a == nil {
+		return true
+	}
+	if a.denied(host, ip, port) {
+		return false
+	}
+	if len(a.allow) == 0 {
+		return true
+	}
+	for _, r := range a.allow {
+		if r.match(host, ip, port) {
+			return true
+		}
+	}
+	return false
+}
+
+// resolvable is used to check the name can be resolved through the
+// remote DNS. The rules about IP address can't be checked before the
+// name is resolved, so if Allow is not empty, the name must match one
+// of the FQDN allow rules, the deny rules with a port are ignored,
+// because the other ports about the name may be allowed.
+func (a *acl) resolvable(name string) bool {
+	if a == nil {
+		return true
+	}
+	for _, r := range a.deny {
+		if r.ipNet == nil && r.port == 0 && r.match(name, nil, 0) {
+			return false
+		}
+	}
+	if len(a.allow) == 0 {
+		return true
+	}
+	for _, r := range a.allow {
+		if r.ipNet == nil && r.match(name, nil, r.port) {
+			return true
+		}
+	}
+	return false
+}
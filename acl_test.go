@@ -0,0 +1,84 @@
+package socks
+
+import (
+	"net"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestACL(t *testing.T) {
+	a := ACL{
+		Allow: []string{"10.0.0.0/8", "*.example.com", "github.com:443", "::1"},
+		Deny:  []string{"10.0.0.1", "bad.example.com"},
+	}
+	c, err := a.compile()
+	require.NoError(t, err)
+	testData := map[string]bool{
+		"10.1.2.3:80":           true,
+		"10.0.0.1:80":           false,
+		"[::1]:22":              true,
+		"www.example.com:80":    true,
+		"BAD.example.com.:80":   false,
+		"example.com:80":        false,
+		"github.com:443":        true,
+		"github.com:80":         false,
+		"192.168.1.1:80":        false,
+		"sub.www.example.com:1": true,
+	}
+	for target, expected := range testData {
+		host, port := splitTarget(t, target)
+		require.Equal(t, expected, c.allowed(host, nil, port), target)
+	}
+	// check with resolved IP address
+	require.True(t, c.allowed("internal.com", net.ParseIP("10.2.3.4"), 80))
+	require.False(t, c.allowed("internal.com", net.ParseIP("10.0.0.1"), 80))
+	require.False(t, c.allowed("bad.example.com", net.ParseIP("10.2.3.4"), 80))
+	require.True(t, c.denied("bad.example.com", nil, 80))
+	require.False(t, c.denied("internal.com", nil, 80))
+	// nil acl allow all
+	var empty *acl
+	require.True(t, empty.allowed("1.1.1.1", nil, 53))
+}
+
+func TestACL_Resolvable(t *testing.T) {
+	a := ACL{
+		Allow: []string{"10.0.0.0/8", "*.example.com", "github.com:443"},
+		Deny:  []string{"bad.example.com", "www.example.com:80"},
+	}
+	c, err := a.compile()
+	require.NoError(t, err)
+	testData := map[string]bool{
+		"www.example.com":  true,
+		"BAD.example.com.": false,
+		"github.com":       true,
+		"internal.com":     false,
+	}
+	for name, expected := range testData {
+		require.Equal(t, expected, c.resolvable(name), name)
+	}
+	// only deny rules
+	c, err = (&ACL{Deny: []string{"*.internal", "10.0.0.0/8"}}).compile()
+	require.NoError(t, err)
+	require.False(t, c.resolvable("db.internal"))
+	require.True(t, c.resolvable("example.com"))
+	// nil acl allow all
+	var empty *acl
+	require.True(t, empty.resolvable("example.com"))
+}
+
+func TestACLInvalidRule(t *testing.T) {
+	for _, rule := range []string{"1.1.1.1/33", "example.com:65536", ":80"} {
+		_, err := (&ACL{Allow: []string{rule}}).compile()
+		require.Error(t, err, rule)
+	}
+}
+
+func splitTarget(t *testing.T, target string) (string, uint16) {
+	host, port, err := net.SplitHostPort(target)
+	require.NoError(t, err)
+	p, err := strconv.ParseUint(port, 10, 16)
+	require.NoError(t, err)
+	return host, uint16(p)
+}
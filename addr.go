@@ -0,0 +1,131 @@
+package socks
+
+import (
+	"net"
+	"strconv"
+	"strings"
+)
+
+// AddrType is the type about Addr.
+type AddrType uint8
+
+// types about Addr, the values are the same as the protocol.
+const (
+	AddrIPv4 = AddrType(typeIPv4)
+	AddrIPv6 = AddrType(typeIPv6)
+	AddrFQDN = AddrType(typeFQDN)
+)
+
+func (t AddrType) String() string {
+	switch t {
+	case AddrIPv4:
+		return "IPv4"
+	case AddrIPv6:
+		return "IPv6"
+	case AddrFQDN:
+		return "FQDN"
+	default:
+		return "unknown"
+	}
+}
+
+// Addr is the connect target, it implements net.Addr. If IP is
+// not nil, it is an IPv4 or IPv6 address, otherwise it is FQDN.
+type Addr struct {
+	IP   net.IP
+	FQDN string
+	Port uint16
+}
+
+// NewAddr is used to create an Addr from host and port, the IPv6
+// host can be enclosed in square brackets like "[::1]".
+func NewAddr(host string, port uint16) (*Addr, error) {
+	if port == 0 {
+		return nil, ErrInvalidPort
+	}
+	if strings.HasPrefix(host, "[") && strings.HasSuffix(host, "]") {
+		ip := net.ParseIP(host[1 : len(host)-1])
+		if ip == nil || ip.To4() != nil {
+			return nil, ErrInvalidType
+		}
+		return &Addr{IP: ip, Port: port}, nil
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return &Addr{IP: ip, Port: port}, nil
+	}
+	err := checkFQDN(host)
+	if err != nil {
+		return nil, err
+	}
+	return &Addr{FQDN: host, Port: port}, nil
+}
+
+// ParseAddr is used to parse Addr from address like "host:port".
+func ParseAddr(address string) (*Addr, error) {
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, ErrInvalidPort
+	}
+	return NewAddr(host, uint16(port))
+}
+
+// AddrFromNetAddr is used to convert net.Addr to Addr, it supports
+// *Addr, *net.TCPAddr, *net.UDPAddr and the address like "host:port".
+func AddrFromNetAddr(addr net.Addr) (*Addr, error) {
+	switch a := addr.(type) {
+	case *Addr:
+		return NewAddr(a.Host(), a.Port)
+	case *net.TCPAddr:
+		return newAddrFromIP(a.IP, a.Port)
+	case *net.UDPAddr:
+		return newAddrFromIP(a.IP, a.Port)
+	default:
+		return ParseAddr(addr.String())
+	}
+}
+
+func newAddrFromIP(ip net.IP, port int) (*Addr, error) {
+	if len(ip) != net.IPv4len && len(ip) != net.IPv6len {
+		return nil, ErrInvalidType
+	}
+	if port <= 0 || port > 65535 {
+		return nil, ErrInvalidPort
+	}
+	return &Addr{IP: ip, Port: uint16(port)}, nil
+}
+
+// Type is used to get the type about address, the IPv4-mapped
+// IPv6 address is treated as IPv4.
+func (a *Addr) Type() AddrType {
+	switch {
+	case a.IP == nil:
+		return AddrFQDN
+	case a.IP.To4() != nil:
+		return AddrIPv4
+	default:
+		return AddrIPv6
+	}
+}
+
+// Host is used to get the host without square brackets.
+func (a *Addr) Host() string {
+	if a.IP != nil {
+		return a.IP.String()
+	}
+	return a.FQDN
+}
+
+// Network is used to implement net.Addr.
+func (a *Addr) Network() string {
+	return "tcp"
+}
+
+// String is used to get the address like "host:port", the IPv6
+// host is enclosed in square brackets.
+func (a *Addr) String() string {
+	return net.JoinHostPort(a.Host(), strconv.Itoa(int(a.Port)))
+}
@@ -0,0 +1,42 @@
+//go:build go1.18
+// +build go1.18
+
+package socks
+
+import (
+	"net"
+	"net/netip"
+)
+
+// NewAddrFromAddrPort is used to create an Addr from netip.AddrPort.
+func NewAddrFromAddrPort(addr netip.AddrPort) (*Addr, error) {
+	if !addr.IsValid() {
+		return nil, ErrInvalidType
+	}
+	if addr.Port() == 0 {
+		return nil, ErrInvalidPort
+	}
+	ip := addr.Addr().Unmap()
+	return &Addr{IP: net.IP(ip.AsSlice()), Port: addr.Port()}, nil
+}
+
+// AddrPort is used to convert Addr to netip.AddrPort, it
+// returns false if the address is FQDN.
+func (a *Addr) AddrPort() (netip.AddrPort, bool) {
+	ip, ok := netip.AddrFromSlice(a.IP)
+	if !ok {
+		return netip.AddrPort{}, false
+	}
+	return netip.AddrPortFrom(ip.Unmap(), a.Port), true
+}
+
+// ConnectAddrPort is like Connect, it uses netip.AddrPort as the target.
+func ConnectAddrPort(conn net.Conn, addr netip.AddrPort) (net.Conn, error) {
+	a, err := NewAddrFromAddrPort(addr)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	conn, _, err = connect(conn, a, nil, false)
+	return conn, err
+}
@@ -0,0 +1,36 @@
+//go:build go1.18
+// +build go1.18
+
+package socks
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewAddrFromAddrPort(t *testing.T) {
+	for _, address := range []string{"1.1.1.1:443", "[::1]:443", "[2001:db8::1]:65535"} {
+		addrPort := netip.MustParseAddrPort(address)
+		addr, err := NewAddrFromAddrPort(addrPort)
+		require.NoError(t, err)
+		require.Equal(t, address, addr.String())
+		ap, ok := addr.AddrPort()
+		require.True(t, ok)
+		require.Equal(t, addrPort, ap)
+	}
+
+	// IPv4-mapped IPv6 address is treated as IPv4
+	addr, err := NewAddrFromAddrPort(netip.MustParseAddrPort("[::ffff:1.1.1.1]:443"))
+	require.NoError(t, err)
+	require.Equal(t, AddrIPv4, addr.Type())
+
+	_, err = NewAddrFromAddrPort(netip.AddrPort{})
+	require.Equal(t, ErrInvalidType, err)
+	_, err = NewAddrFromAddrPort(netip.MustParseAddrPort("1.1.1.1:0"))
+	require.Equal(t, ErrInvalidPort, err)
+
+	_, ok := (&Addr{FQDN: "google.com", Port: 443}).AddrPort()
+	require.False(t, ok)
+}
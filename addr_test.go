@@ -0,0 +1,78 @@
+package socks
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewAddr(t *testing.T) {
+	testData := []struct {
+		host    string
+		typ     AddrType
+		address string
+	}{
+		{"1.1.1.1", AddrIPv4, "1.1.1.1:443"},
+		{"::ffff:1.1.1.1", AddrIPv4, "1.1.1.1:443"},
+		{"::1", AddrIPv6, "[::1]:443"},
+		{"[::1]", AddrIPv6, "[::1]:443"},
+		{"2001:db8::1", AddrIPv6, "[2001:db8::1]:443"},
+		{"google.com", AddrFQDN, "google.com:443"},
+	}
+	for _, td := range testData {
+		addr, err := NewAddr(td.host, 443)
+		require.NoError(t, err)
+		require.Equal(t, td.typ, addr.Type())
+		require.Equal(t, td.address, addr.String())
+		require.Equal(t, "tcp", addr.Network())
+
+		// round trip about protocol
+		b, err := packHostData(addr)
+		require.NoError(t, err)
+		require.Equal(t, uint8(td.typ), b[0])
+		unpacked, err := unpackHostData(bytes.NewReader(b))
+		require.NoError(t, err)
+		require.Equal(t, td.typ, unpacked.Type())
+		require.Equal(t, td.address, unpacked.String())
+
+		// round trip about string
+		parsed, err := ParseAddr(addr.String())
+		require.NoError(t, err)
+		require.Equal(t, td.address, parsed.String())
+	}
+
+	for _, host := range []string{"", "[1.1.1.1]", "[google.com]", "a/b"} {
+		_, err := NewAddr(host, 443)
+		require.Error(t, err)
+	}
+	_, err := NewAddr("google.com", 0)
+	require.Equal(t, ErrInvalidPort, err)
+}
+
+func TestParseAddr(t *testing.T) {
+	for _, address := range []string{"google.com", "google.com:0", "google.com:65536", "[::1:443"} {
+		_, err := ParseAddr(address)
+		require.Error(t, err)
+	}
+}
+
+func TestAddrFromNetAddr(t *testing.T) {
+	testData := map[string]net.Addr{
+		"1.1.1.1:443":     &net.TCPAddr{IP: net.IPv4(1, 1, 1, 1), Port: 443},
+		"[::1]:53":        &net.UDPAddr{IP: net.IPv6loopback, Port: 53},
+		"google.com:443":  &Addr{FQDN: "google.com", Port: 443},
+		"[2001:db8::1]:1": &Addr{IP: net.ParseIP("2001:db8::1"), Port: 1},
+	}
+	for expected, netAddr := range testData {
+		addr, err := AddrFromNetAddr(netAddr)
+		require.NoError(t, err)
+		require.Equal(t, expected, addr.String())
+	}
+
+	_, err := AddrFromNetAddr(&net.TCPAddr{IP: net.IPv4(1, 1, 1, 1)})
+	require.Equal(t, ErrInvalidPort, err)
+	_, err = AddrFromNetAddr(&net.TCPAddr{Port: 443})
+	require.Equal(t, ErrInvalidType, err)
+}
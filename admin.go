@@ -0,0 +1,138 @@
+package socks
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// admin API
+//
+// GET    /sessions       list active sessions
+// DELETE /sessions/{id}  terminate a session
+// GET    /users          list users
+// PUT    /users/{name}   add or update a user, body is User
+// DELETE /users/{name}   delete a user
+
+// ListenAndServeAdmin is used to start the admin HTTP API, address
+// must be a loopback address like "localhost:1524" or a unix socket
+// like "unix:/var/run/quic-socks.sock", it returns ErrConnClosed if the
+// server is closed before the admin API started.
+func (s *Server) ListenAndServeAdmin(address string) error {
+	listener, err := listenAdmin(address)
+	if err != nil {
+		return err
+	}
+	server := http.Server{
+		Handler:     s.adminHandler(),
+		ReadTimeout: time.Minute,
+	}
+	// the server may be closed during listen
+	s.adminRWM.Lock()
+	if s.adminClosed {
+		s.adminRWM.Unlock()
+		_ = listener.Close()
+		return ErrConnClosed
+	}
+	s.admin = &server
+	s.adminRWM.Unlock()
+	err = server.Serve(listener)
+	if err == http.ErrServerClosed {
+		return nil
+	}
+	return err
+}
+
+func listenAdmin(address string) (net.Listener, error) {
+	if strings.HasPrefix(address, "unix:") {
+		return net.Listen("unix", strings.TrimPrefix(address, "unix:"))
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	addr, err := net.ResolveIPAddr("ip", host)
+	if err != nil {
+		return nil, err
+	}
+	if !addr.IP.IsLoopback() {
+		return nil, errors.Errorf("admin address %s is not a loopback address", address)
+	}
+	return net.Listen("tcp", address)
+}
+
+func (s *Server) adminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/sessions", s.handleSessions)
+	mux.HandleFunc("/sessions/", s.handleSessions)
+	mux.HandleFunc("/users", s.handleUsers)
+	mux.HandleFunc("/users/", s.handleUsers)
+	return mux
+}
+
+func (s *Server) handleSessions(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/sessions"), "/")
+	switch {
+	case r.Method == http.MethodGet && id == "":
+		writeJSON(w, http.StatusOK, s.Sessions())
+	case r.Method == http.MethodDelete && id != "":
+		n, err := strconv.ParseUint(id, 10, 64)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		err = s.CloseSession(n)
+		if err != nil {
+			writeError(w, http.StatusNotFound, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+	}
+}
+
+func (s *Server) handleUsers(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/users"), "/")
+	switch {
+	case r.Method == http.MethodGet && name == "":
+		writeJSON(w, http.StatusOK, s.Users())
+	case r.Method == http.MethodPut && name != "":
+		u := User{}
+		err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&u)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		err = s.SetUser(name, &u)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodDelete && name != "":
+		err := s.DeleteUser(name)
+		if err != nil {
+			writeError(w, http.StatusNotFound, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+	}
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, code int, err error) {
+	writeJSON(w, code, map[string]string{"error": err.Error()})
+}
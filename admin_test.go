@@ -0,0 +1,128 @@
+package socks
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// testAdminDo is used to send the request to the admin API and
+// check the status code, it returns the response body.
+func testAdminDo(t *testing.T, method, url, body string, code int) []byte {
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	require.NoError(t, err)
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer func() { _ = resp.Body.Close() }()
+	b, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Equal(t, code, resp.StatusCode, string(b))
+	return b
+}
+
+func TestAdmin(t *testing.T) {
+	echo := testListen(t, testEcho)
+	defer func() { _ = echo.Close() }()
+	server, client := testServer(t)
+	defer server.Close()
+	admin := httptest.NewServer(server.adminHandler())
+	defer admin.Close()
+	host, port := splitTarget(t, echo.Addr().String())
+
+	t.Run("sessions", func(t *testing.T) {
+		conn, err := client.DialConnect(host, port, []byte("hello"))
+		require.NoError(t, err)
+		defer func() { _ = conn.Close() }()
+		buf := make([]byte, 5)
+		_, err = conn.Read(buf)
+		require.NoError(t, err)
+
+		var sessions []*SessionInfo
+		b := testAdminDo(t, http.MethodGet, admin.URL+"/sessions", "", http.StatusOK)
+		require.NoError(t, json.Unmarshal(b, &sessions))
+		require.Len(t, sessions, 1)
+		require.Equal(t, DefaultUser, sessions[0].User)
+		require.Equal(t, echo.Addr().String(), sessions[0].Target)
+
+		id := strconv.FormatUint(sessions[0].ID, 10)
+		testAdminDo(t, http.MethodDelete, admin.URL+"/sessions/"+id, "", http.StatusNoContent)
+		_ = conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+		_, err = ioutil.ReadAll(conn)
+		require.Error(t, err)
+		require.Eventually(t, func() bool {
+			return len(server.Sessions()) == 0
+		}, 10*time.Second, 10*time.Millisecond)
+
+		testAdminDo(t, http.MethodDelete, admin.URL+"/sessions/"+id, "", http.StatusNotFound)
+		testAdminDo(t, http.MethodDelete, admin.URL+"/sessions/foo", "", http.StatusBadRequest)
+		testAdminDo(t, http.MethodPost, admin.URL+"/sessions", "", http.StatusMethodNotAllowed)
+	})
+
+	t.Run("users", func(t *testing.T) {
+		body := `{"password":"pwd","acl":{"deny":["10.0.0.0/8"]}}`
+		testAdminDo(t, http.MethodPut, admin.URL+"/users/alice", body, http.StatusNoContent)
+		var users []*UserInfo
+		b := testAdminDo(t, http.MethodGet, admin.URL+"/users", "", http.StatusOK)
+		require.NoError(t, json.Unmarshal(b, &users))
+		require.Len(t, users, 2)
+		require.Equal(t, "alice", users[0].Name)
+		require.Equal(t, []string{"10.0.0.0/8"}, users[0].ACL.Deny)
+		require.NotContains(t, string(b), "pwd")
+
+		// invalid user
+		body = `{"password":"pwd","acl":{"deny":["10.0.0.0/33"]}}`
+		testAdminDo(t, http.MethodPut, admin.URL+"/users/alice", body, http.StatusBadRequest)
+		testAdminDo(t, http.MethodPut, admin.URL+"/users/alice", `{}`, http.StatusBadRequest)
+		testAdminDo(t, http.MethodPut, admin.URL+"/users/alice", `{`, http.StatusBadRequest)
+
+		testAdminDo(t, http.MethodDelete, admin.URL+"/users/alice", "", http.StatusNoContent)
+		testAdminDo(t, http.MethodDelete, admin.URL+"/users/alice", "", http.StatusNotFound)
+		testAdminDo(t, http.MethodPost, admin.URL+"/users", "", http.StatusMethodNotAllowed)
+	})
+
+	t.Run("update acl", func(t *testing.T) {
+		body := `{"password":"test","acl":{"deny":["` + host + `"]}}`
+		testAdminDo(t, http.MethodPut, admin.URL+"/users/"+DefaultUser, body, http.StatusNoContent)
+		_, err := client.DialConnect(host, port, nil)
+		require.Equal(t, ErrNotAllowed, err)
+
+		testAdminDo(t, http.MethodPut, admin.URL+"/users/"+DefaultUser, `{"password":"test"}`, http.StatusNoContent)
+		conn, err := client.DialConnect(host, port, nil)
+		require.NoError(t, err)
+		_ = conn.Close()
+	})
+}
+
+func TestListenAdmin(t *testing.T) {
+	dir, err := ioutil.TempDir("", "quic-socks")
+	require.NoError(t, err)
+	defer func() { _ = os.RemoveAll(dir) }()
+	for _, address := range []string{
+		"localhost:0",
+		"127.0.0.1:0",
+		"[::1]:0",
+		"unix:" + filepath.Join(dir, "admin.sock"),
+	} {
+		listener, err := listenAdmin(address)
+		require.NoError(t, err, address)
+		_ = listener.Close()
+	}
+	for _, address := range []string{"0.0.0.0:0", ":0", "8.8.8.8:0", "localhost"} {
+		_, err := listenAdmin(address)
+		require.Error(t, err, address)
+	}
+
+	// the server is closed before the admin API started
+	server, _ := testServer(t)
+	server.Close()
+	require.Equal(t, ErrConnClosed, server.ListenAndServeAdmin("localhost:0"))
+}
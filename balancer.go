@@ -0,0 +1,356 @@
+package socks
+
+import (
+	"crypto/tls"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Dialer is used to dial an authenticated connection to
+// a quic-socks server, Client and Balancer implement it.
+type Dialer interface {
+	Dial() (net.Conn, error)
+}
+
+// Strategy is the strategy about select upstream server.
+type Strategy uint8
+
+// strategies about Balancer.
+const (
+	Failover     Strategy = iota // by the order of servers
+	RoundRobin                   // rotate servers
+	LeastLatency                 // the server with the least latency first
+	Weighted                     // smooth weighted round-robin
+)
+
+// ParseStrategy is used to parse Strategy from string like "round-robin".
+func ParseStrategy(strategy string) (Strategy, error) {
+	switch strategy {
+	case "", "failover":
+		return Failover, nil
+	case "round-robin":
+		return RoundRobin, nil
+	case "least-latency":
+		return LeastLatency, nil
+	case "weighted":
+		return Weighted, nil
+	default:
+		return 0, errors.Errorf("unknown strategy \"%s\"", strategy)
+	}
+}
+
+// Upstream is a quic-socks server about Balancer.
+type Upstream struct {
+	Address   string
+	Password  []byte
+	TLSConfig *tls.Config
+	Weight    int // only for Weighted, default is 1
+
+	// TCPAddress is the TLS over TCP address about the
+	// server, if it is set, the TCP fallback is enabled
+	TCPAddress string
+}
+
+// BalancerOptions contains options about Balancer.
+type BalancerOptions struct {
+	Strategy Strategy
+
+	// ProbeInterval is the interval about health probe, default
+	// is 30s, negative will disable it, ejected servers will be
+	// re-admitted after a successful probe
+	ProbeInterval time.Duration
+
+	// MaxFails is the number of the consecutive failures
+	// before a server is ejected, default is 3
+	MaxFails int
+}
+
+// UpstreamStatus is the status about an upstream server.
+type UpstreamStatus struct {
+	Address string
+	Healthy bool
+	Latency time.Duration
+	Fails   int
+}
+
+type upstream struct {
+	latency int64 // nanosecond, EWMA, atomic
+	fails   int32 // atomic
+	healthy int32 // atomic
+
+	client  *Client
+	address string
+	weight  int
+	current int // for smooth weighted round-robin
+}
+
+func (u *upstream) isHealthy() bool {
+	return atomic.LoadInt32(&u.healthy) == 1
+}
+
+func (u *upstream) success(latency time.Duration) {
+	atomic.StoreInt32(&u.fails, 0)
+	atomic.StoreInt32(&u.healthy, 1)
+	// EWMA, retry if the latency is updated by the other success
+	for {
+		old := atomic.LoadInt64(&u.latency)
+		latest := int64(latency)
+		if old != 0 {
+			latest = (old*7 + latest) / 8
+		}
+		if atomic.CompareAndSwapInt64(&u.latency, old, latest) {
+			return
+		}
+	}
+}
+
+func (u *upstream) fail(maxFails int) {
+	if int(atomic.AddInt32(&u.fails, 1)) >= maxFails {
+		atomic.StoreInt32(&u.healthy, 0)
+	}
+}
+
+// Balancer is used to dial one of the quic-socks servers by the strategy,
+// unhealthy servers are ejected and only used when all servers are ejected.
+type Balancer struct {
+	servers       []*upstream
+	strategy      Strategy
+	probeInterval time.Duration
+	maxFails      int
+
+	next       uint32     // for RoundRobin
+	weightedMu sync.Mutex // for Weighted
+
+	stopSignal chan struct{}
+	wg         sync.WaitGroup
+}
+
+// NewBalancer is used to create a balancer with multiple servers.
+func NewBalancer(upstreams []*Upstream, opts *BalancerOptions) (*Balancer, error) {
+	if len(upstreams) == 0 {
+		return nil, errors.New("no upstream servers")
+	}
+	if opts == nil {
+		opts = new(BalancerOptions)
+	}
+	b := Balancer{
+		strategy:      opts.Strategy,
+		probeInterval: opts.ProbeInterval,
+		maxFails:      opts.MaxFails,
+		stopSignal:    make(chan struct{}),
+	}
+	if b.probeInterval == 0 {
+		b.probeInterval = 30 * time.Second
+	}
+	if b.maxFails <= 0 {
+		b.maxFails = 3
+	}
+	for _, u := range upstreams {
+		tlsConfig := new(tls.Config)
+		if u.TLSConfig != nil {
+			tlsConfig = u.TLSConfig.Clone()
+		}
+		client, err := NewClient(u.Address, u.Password, tlsConfig)
+		if err != nil {
+			return nil, err
+		}
+		if u.TCPAddress != "" {
+			client.SetTCPFallback(&TCPFallbackOptions{Address: u.TCPAddress})
+		}
+		weight := u.Weight
+		if weight <= 0 {
+			weight = 1
+		}
+		b.servers = append(b.servers, &upstream{
+			healthy: 1,
+			client:  client,
+			address: u.Address,
+			weight:  weight,
+		})
+	}
+	if b.probeInterval > 0 {
+		b.wg.Add(1)
+		go b.probeLoop()
+	}
+	return &b, nil
+}
+
+// Dial is used to dial a server selected by the strategy,
+// if it failed, the next server will be tried.
+func (b *Balancer) Dial() (net.Conn, error) {
+	var err error
+	for _, u := range b.candidates() {
+		var conn net.Conn
+		start := time.Now()
+		conn, err = u.client.Dial()
+		if err != nil {
+			u.fail(b.maxFails)
+			continue
+		}
+		u.success(time.Since(start))
+		return conn, nil
+	}
+	return nil, err
+}
+
+// DialConnect is like Client.DialConnect, it selects server like Dial.
+func (b *Balancer) DialConnect(host string, port uint16, payload []byte) (net.Conn, error) {
+	// the invalid target is not about the server
+	_, err := NewAddr(host, port)
+	if err != nil {
+		return nil, err
+	}
+	var conn net.Conn
+	err = b.dialConnect(func(client *Client) (err error) {
+		conn, err = client.DialConnect(host, port, payload)
+		return
+	})
+	return conn, err
+}
+
+// DialConnectBound is like Client.DialConnectBound, it selects server like Dial.
+func (b *Balancer) DialConnectBound(addr net.Addr, payload []byte) (net.Conn, *Addr, error) {
+	a, err := AddrFromNetAddr(addr)
+	if err != nil {
+		return nil, nil, err
+	}
+	var (
+		conn  net.Conn
+		bound *Addr
+	)
+	err = b.dialConnect(func(client *Client) (err error) {
+		conn, bound, err = client.DialConnectBound(a, payload)
+		return
+	})
+	return conn, bound, err
+}
+
+func (b *Balancer) dialConnect(dial func(client *Client) error) error {
+	var err error
+	for _, u := range b.candidates() {
+		start := time.Now()
+		err = dial(u.client)
+		if err != nil {
+			// the target error is not about the server
+			if _, ok := err.(Response); ok {
+				return err
+			}
+			u.fail(b.maxFails)
+			continue
+		}
+		u.success(time.Since(start))
+		return nil
+	}
+	return err
+}
+
+// candidates is used to order servers by the strategy,
+// unhealthy servers are at the end of the list.
+func (b *Balancer) candidates() []*upstream {
+	var healthy, unhealthy []*upstream
+	for _, u := range b.servers {
+		if u.isHealthy() {
+			healthy = append(healthy, u)
+		} else {
+			unhealthy = append(unhealthy, u)
+		}
+	}
+	if l := len(healthy); l > 1 {
+		switch b.strategy {
+		case RoundRobin:
+			i := int(atomic.AddUint32(&b.next, 1)) % l
+			healthy = append(healthy[i:], healthy[:i]...)
+		case LeastLatency:
+			sort.SliceStable(healthy, func(i, j int) bool {
+				return atomic.LoadInt64(&healthy[i].latency) < atomic.LoadInt64(&healthy[j].latency)
+			})
+		case Weighted:
+			selected := b.selectWeighted(healthy)
+			for i := 0; i < l; i++ {
+				if healthy[i] == selected {
+					healthy[0], healthy[i] = healthy[i], healthy[0]
+					break
+				}
+			}
+		}
+	}
+	return append(healthy, unhealthy...)
+}
+
+// selectWeighted is the smooth weighted round-robin like nginx.
+func (b *Balancer) selectWeighted(servers []*upstream) *upstream {
+	b.weightedMu.Lock()
+	defer b.weightedMu.Unlock()
+	var (
+		selected *upstream
+		total    int
+	)
+	for _, u := range servers {
+		u.current += u.weight
+		total += u.weight
+		if selected == nil || u.current > selected.current {
+			selected = u
+		}
+	}
+	selected.current -= total
+	return selected
+}
+
+func (b *Balancer) probeLoop() {
+	defer b.wg.Done()
+	ticker := time.NewTicker(b.probeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			b.probe()
+		case <-b.stopSignal:
+			return
+		}
+	}
+}
+
+// probe is used to dial all servers for check health and measure latency.
+func (b *Balancer) probe() {
+	wg := sync.WaitGroup{}
+	for _, u := range b.servers {
+		wg.Add(1)
+		go func(u *upstream) {
+			defer wg.Done()
+			start := time.Now()
+			conn, err := u.client.Dial()
+			if err != nil {
+				u.fail(b.maxFails)
+				return
+			}
+			u.success(time.Since(start))
+			_ = conn.Close()
+		}(u)
+	}
+	wg.Wait()
+}
+
+// Status is used to get the status about all servers.
+func (b *Balancer) Status() []*UpstreamStatus {
+	status := make([]*UpstreamStatus, len(b.servers))
+	for i, u := range b.servers {
+		status[i] = &UpstreamStatus{
+			Address: u.address,
+			Healthy: u.isHealthy(),
+			Latency: time.Duration(atomic.LoadInt64(&u.latency)),
+			Fails:   int(atomic.LoadInt32(&u.fails)),
+		}
+	}
+	return status
+}
+
+// Close is used to stop the health probe.
+func (b *Balancer) Close() {
+	close(b.stopSignal)
+	b.wg.Wait()
+}
@@ -0,0 +1,81 @@
+package socks
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func testBalancer(strategy Strategy, weights ...int) *Balancer {
+	b := Balancer{strategy: strategy, maxFails: 3}
+	for i, w := range weights {
+		b.servers = append(b.servers, &upstream{
+			healthy: 1,
+			address: string(rune('a' + i)),
+			weight:  w,
+		})
+	}
+	return &b
+}
+
+func candidateAddrs(b *Balancer) string {
+	var s string
+	for _, u := range b.candidates() {
+		s += u.address
+	}
+	return s
+}
+
+func TestBalancer_Failover(t *testing.T) {
+	b := testBalancer(Failover, 1, 1, 1)
+	require.Equal(t, "abc", candidateAddrs(b))
+	// eject after max fails
+	b.servers[0].fail(b.maxFails)
+	b.servers[0].fail(b.maxFails)
+	require.Equal(t, "abc", candidateAddrs(b))
+	b.servers[0].fail(b.maxFails)
+	require.Equal(t, "bca", candidateAddrs(b))
+	// re-admit
+	b.servers[0].success(time.Millisecond)
+	require.Equal(t, "abc", candidateAddrs(b))
+}
+
+func TestBalancer_RoundRobin(t *testing.T) {
+	b := testBalancer(RoundRobin, 1, 1, 1)
+	require.Equal(t, "bca", candidateAddrs(b))
+	require.Equal(t, "cab", candidateAddrs(b))
+	require.Equal(t, "abc", candidateAddrs(b))
+}
+
+func TestBalancer_LeastLatency(t *testing.T) {
+	b := testBalancer(LeastLatency, 1, 1, 1)
+	b.servers[0].success(30 * time.Millisecond)
+	b.servers[1].success(10 * time.Millisecond)
+	b.servers[2].success(20 * time.Millisecond)
+	require.Equal(t, "bca", candidateAddrs(b))
+}
+
+func TestBalancer_Weighted(t *testing.T) {
+	b := testBalancer(Weighted, 5, 1, 1)
+	count := make(map[string]int)
+	for i := 0; i < 70; i++ {
+		count[b.candidates()[0].address]++
+	}
+	require.Equal(t, map[string]int{"a": 50, "b": 10, "c": 10}, count)
+}
+
+func TestParseStrategy(t *testing.T) {
+	for s, expected := range map[string]Strategy{
+		"failover":      Failover,
+		"round-robin":   RoundRobin,
+		"least-latency": LeastLatency,
+		"weighted":      Weighted,
+	} {
+		strategy, err := ParseStrategy(s)
+		require.NoError(t, err)
+		require.Equal(t, expected, strategy)
+	}
+	_, err := ParseStrategy("random")
+	require.Error(t, err)
+}
@@ -9,18 +9,29 @@ import (
 	"net"
 	"os"
 	"time"
-
-	"github.com/lucas-clemente/quic-go"
 )
 
 type Client struct {
 	address   string
 	hash      []byte
 	tlsConfig *tls.Config
-	session   quic.Session // wait quic-go support BBR
+	transport Transport
+	fallback  *tcpFallback
 }
 
 func NewClient(address string, password []byte, tlsConfig *tls.Config) (*Client, error) {
+	return NewClientWithTransport(NewQUICTransport(), address, password, tlsConfig)
+}
+
+// NewClientWithTransport is like NewClient, the sessions
+// to the server are created by the transport.
+//
+// A TLS session cache is installed if tlsConfig.ClientSessionCache
+// is nil, so the later sessions resume the TLS session. It doesn't
+// support 0-RTT, the resumed handshake still takes 1-RTT before the
+// auth, no replay-safe early data is sent.
+func NewClientWithTransport(transport Transport, address string, password []byte,
+	tlsConfig *tls.Config) (*Client, error) {
 	// skip QUIC debug log about BBR
 	err := os.Setenv("GODEBUG", "bbr=1")
 	if err != nil {
@@ -31,67 +42,117 @@ func NewClient(address string, password []byte, tlsConfig *tls.Config) (*Client,
 		address:   address,
 		hash:      hash[:],
 		tlsConfig: tlsConfig,
+		transport: transport,
 	}
 	tlsConfig.NextProtos = append(tlsConfig.NextProtos, nextProto)
+	// enable TLS session resumption for reduce the handshake cost
+	if tlsConfig.ClientSessionCache == nil {
+		tlsConfig.ClientSessionCache = tls.NewLRUClientSessionCache(32)
+	}
 	return &client, nil
 }
 
+// Dial is used to dial the server and finish the authentication.
 func (c *Client) Dial() (net.Conn, error) {
-	rAddr, err := net.ResolveUDPAddr("udp", c.address)
+	conn, err := c.dial()
 	if err != nil {
 		return nil, err
 	}
-	udpConn, err := net.ListenUDP("udp", nil)
+	_, err = conn.Write(c.authData())
 	if err != nil {
+		_ = conn.Close()
 		return nil, err
 	}
-	var success bool
-	defer func() {
-		if !success {
-			_ = udpConn.Close()
-		}
-	}()
-	quicCfg := quic.Config{
-		HandshakeTimeout: 30 * time.Second,
-		IdleTimeout:      10 * time.Minute,
-		KeepAlive:        true,
-	}
-	session, err := quic.Dial(udpConn, rAddr, c.address, c.tlsConfig, &quicCfg)
+	authResp := make([]byte, 1)
+	_, err = io.ReadFull(conn, authResp)
 	if err != nil {
+		_ = conn.Close()
 		return nil, err
 	}
-	defer func() {
-		if !success {
-			_ = session.CloseWithError(0, "no error")
-		}
-	}()
-	stream, err := session.OpenStreamSync()
+	if authResp[0] != authOK {
+		_ = conn.Close()
+		return nil, Response(authResp[0])
+	}
+	return conn, nil
+}
+
+// DialConnect is used to send the authentication, the connect request
+// and the initial payload(can be nil) together, then read the combined
+// response, it saves a round trip than Dial with Connect.
+func (c *Client) DialConnect(host string, port uint16, payload []byte) (net.Conn, error) {
+	addr, err := NewAddr(host, port)
 	if err != nil {
 		return nil, err
 	}
-	defer func() {
-		if !success {
-			_ = stream.Close()
-		}
-	}()
-	// write data for prevent block
-	_ = stream.SetWriteDeadline(time.Now().Add(30 * time.Second))
-	_, err = stream.Write([]byte{0})
+	conn, _, err := c.dialConnect(addr, payload, false)
+	return conn, err
+}
+
+// DialConnectBound is like DialConnect, it also returns the bound
+// address about the target connection reported by the server.
+func (c *Client) DialConnectBound(addr net.Addr, payload []byte) (net.Conn, *Addr, error) {
+	a, err := AddrFromNetAddr(addr)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
+	return c.dialConnect(a, payload, true)
+}
 
-	conn := &Conn{rawConn: udpConn, session: session, stream: stream}
-	defer func() {
-		if !success {
+func (c *Client) dialConnect(addr *Addr, payload []byte, bound bool) (net.Conn, *Addr, error) {
+	hostData, err := packHostData(addr)
+	if err != nil {
+		return nil, nil, err
+	}
+	if bound {
+		hostData[0] |= typeBound
+	}
+	conn, err := c.dial()
+	if err != nil {
+		return nil, nil, err
+	}
+	buf := bytes.Buffer{}
+	buf.Write(c.authData())
+	buf.Write(hostData)
+	buf.Write(payload)
+	_, err = conn.Write(buf.Bytes())
+	if err != nil {
+		_ = conn.Close()
+		return nil, nil, err
+	}
+	// auth response + connect response
+	resp := make([]byte, 1+respSize)
+	_, err = io.ReadFull(conn, resp)
+	if err != nil {
+		_ = conn.Close()
+		return nil, nil, err
+	}
+	if resp[0] != authOK {
+		_ = conn.Close()
+		return nil, nil, Response(resp[0])
+	}
+	if resp[1] != respOK {
+		_ = conn.Close()
+		return nil, nil, Response(resp[1])
+	}
+	var boundAddr *Addr
+	if bound {
+		boundAddr, err = unpackAddr(conn)
+		if err != nil {
 			_ = conn.Close()
+			return nil, nil, err
 		}
-	}()
+	}
+	_ = conn.SetDeadline(time.Time{})
+	return conn, boundAddr, nil
+}
 
-	_ = conn.SetDeadline(time.Now().Add(time.Minute))
-	paddingSize := 128 + rand.Intn(128)
+// authData is password hash with random padding, the first
+// byte of the padding is the padding size minus 128.
+func (c *Client) authData() []byte {
+	paddingSize := minPaddingSize + rand.Intn(128)
 	padding := make([]byte, paddingSize)
-	for i := 0; i < paddingSize; i++ {
+	padding[0] = byte(paddingSize - minPaddingSize)
+	for i := 1; i < paddingSize; i++ {
 		padding[i] = byte(rand.Intn(256))
 	}
 	tempHash := sha256.New()
@@ -100,44 +161,86 @@ func (c *Client) Dial() (net.Conn, error) {
 	buf := bytes.Buffer{}
 	buf.Write(tempHash.Sum(nil))
 	buf.Write(padding)
-	_, err = io.Copy(conn, &buf)
+	return buf.Bytes()
+}
+
+// Connect is used to send the connect request with an authenticated conn.
+func Connect(conn net.Conn, host string, port uint16) (net.Conn, error) {
+	return ConnectWithPayload(conn, host, port, nil)
+}
+
+// ConnectWithPayload is like Connect, it sends the initial payload
+// with the connect request, the server will write it to the target
+// after connected.
+func ConnectWithPayload(conn net.Conn, host string, port uint16, payload []byte) (net.Conn, error) {
+	addr, err := NewAddr(host, port)
 	if err != nil {
+		_ = conn.Close()
 		return nil, err
 	}
-	authResp := make([]byte, 1)
-	_, err = io.ReadFull(conn, authResp)
+	conn, _, err = connect(conn, addr, payload, false)
+	return conn, err
+}
+
+// ConnectAddr is like Connect, the addr can be *Addr, *net.TCPAddr,
+// *net.UDPAddr or the other net.Addr about "host:port".
+func ConnectAddr(conn net.Conn, addr net.Addr) (net.Conn, error) {
+	a, err := AddrFromNetAddr(addr)
 	if err != nil {
+		_ = conn.Close()
 		return nil, err
 	}
-	if authResp[0] != authOK {
-		return nil, Response(authResp[0])
+	conn, _, err = connect(conn, a, nil, false)
+	return conn, err
+}
+
+// ConnectBound is like ConnectAddr with the initial payload, it also
+// returns the bound address about the target connection reported by
+// the server, the server before the bound address is supported will
+// reply ErrInvalidHost.
+func ConnectBound(conn net.Conn, addr net.Addr, payload []byte) (net.Conn, *Addr, error) {
+	a, err := AddrFromNetAddr(addr)
+	if err != nil {
+		_ = conn.Close()
+		return nil, nil, err
 	}
-	success = true
-	return conn, nil
+	return connect(conn, a, payload, true)
 }
 
-func Connect(conn net.Conn, host string, port uint16) (net.Conn, error) {
-	hostData, err := packHostData(host, port)
+func connect(conn net.Conn, addr *Addr, payload []byte, bound bool) (net.Conn, *Addr, error) {
+	hostData, err := packHostData(addr)
 	if err != nil {
-		return nil, err
+		_ = conn.Close()
+		return nil, nil, err
+	}
+	if bound {
+		hostData[0] |= typeBound
 	}
 	// send request
-	_, err = conn.Write(hostData)
+	_, err = conn.Write(append(hostData, payload...))
 	if err != nil {
 		_ = conn.Close()
-		return nil, err
+		return nil, nil, err
 	}
 	// receive response
 	resp := make([]byte, respSize)
 	_, err = io.ReadFull(conn, resp)
 	if err != nil {
 		_ = conn.Close()
-		return nil, err
+		return nil, nil, err
 	}
 	if resp[0] != respOK {
 		_ = conn.Close()
-		return nil, Response(resp[0])
+		return nil, nil, Response(resp[0])
+	}
+	var boundAddr *Addr
+	if bound {
+		boundAddr, err = unpackAddr(conn)
+		if err != nil {
+			_ = conn.Close()
+			return nil, nil, err
+		}
 	}
 	_ = conn.SetDeadline(time.Time{})
-	return conn, nil
+	return conn, boundAddr, nil
 }
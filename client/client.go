@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bytes"
 	"crypto/subtle"
 	"crypto/tls"
 	"crypto/x509"
@@ -12,8 +13,10 @@ import (
 	"io/ioutil"
 	"log"
 	"net"
+	"net/url"
 	"os"
 	"os/signal"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -22,6 +25,11 @@ import (
 )
 
 func main() {
+	os.Exit(run())
+}
+
+// run is used to start the client, it returns the exit code.
+func run() int {
 	var (
 		localAddr  string
 		remoteAddr string
@@ -30,98 +38,240 @@ func main() {
 		preConns   int
 		socksUser  string
 		socksPwd   string
+		usersPath  string
+		tcpPort    string
+		wsURL      string
+		bound      bool
+		dnsAddr    string
+		strategy   string
+		probe      time.Duration
+		preAge     time.Duration
+		pipeline   bool
+		fast       bool
+		fastWait   time.Duration
+		relayOpts  socks.RelayOptions
+		reverses   reverseFlag
+		forwards   forwardFlag
 	)
 	flag.StringVar(&localAddr, "l", "localhost:1080", "local bind address")
-	flag.StringVar(&remoteAddr, "r", "localhost:1523", "server bind address")
+	flag.StringVar(&remoteAddr, "r", "localhost:1523",
+		"server addresses split by \",\", add \"=weight\" for weighted strategy like host:1523=2")
+	flag.StringVar(&tcpPort, "tcp", "",
+		"TLS over TCP port about the servers, fall back to it when UDP is blocked")
+	flag.StringVar(&wsURL, "ws", "",
+		"WebSocket URL about the server like wss://cdn.example.com/path, it replaces -r")
 	flag.StringVar(&password, "p", "123456", "password")
 	flag.StringVar(&certPath, "c", "cert.pem", "tls certificate file path")
-	flag.IntVar(&preConns, "pre", 128, "the number of the pre-connected connection")
+	flag.IntVar(&preConns, "pre", 128, "the maximum number of the pre-connected connection")
+	flag.DurationVar(&preAge, "pre-age", 45*time.Second, "the maximum age of the pre-connected connection")
 	flag.StringVar(&socksUser, "su", "", "the username about local socks server")
 	flag.StringVar(&socksPwd, "sp", "", "the password about local socks server")
+	flag.StringVar(&usersPath, "users", "",
+		"the users file about local socks server, one \"username:password\" per line")
+	flag.BoolVar(&bound, "bound", false,
+		"reply the bound address reported by the server, the server must support it,"+
+			" it is ignored in fast mode because the reply is sent before connected")
+	flag.StringVar(&dnsAddr, "dns", "", "local DNS forwarder address like 127.0.0.1:5353")
+	flag.StringVar(&strategy, "strategy", "failover",
+		"multiple servers strategy: failover, round-robin, least-latency or weighted")
+	flag.DurationVar(&probe, "probe", 30*time.Second, "health probe interval about multiple servers")
+	flag.BoolVar(&pipeline, "pipeline", false,
+		"send auth and connect request together when no pre-connection is available")
+	flag.BoolVar(&fast, "fast", false,
+		"reply socks5 success before connected and send the first bytes with the connect request,"+
+			" it waits the first bytes with -fast-wait, except the ports that the server speaks first")
+	flag.DurationVar(&fastWait, "fast-wait", 50*time.Millisecond,
+		"the time about wait the first bytes in fast mode, 0 to disable")
+	flag.DurationVar(&relayOpts.IdleTimeout, "idle", 5*time.Minute, "relay idle timeout, negative to disable")
+	flag.IntVar(&relayOpts.BufferSize, "buffer", 32*1024, "relay buffer size per direction")
+	flag.Var(&reverses, "R", "reverse tunnel like \"8080:localhost:80\", the server listens on the port"+
+		" and the connections are forwarded to the target, can be set multiple times")
+	flag.Var(&forwards, "L", "local forward like \"5432:db.internal:5432\" bound to the loopback, or \"*:5432:db.internal:5432\""+
+		" bound to all interfaces, IPv6 addresses need square brackets, the connections are sent to the"+
+		" target without socks5, can be set multiple times")
 	flag.Parse()
 
+	// netcat mode like "client [flags] nc host port", stdout is the
+	// data stream, so the setup errors are printed to stderr
+	ncMode := flag.Arg(0) == "nc"
+	var errOut io.Writer = os.Stdout
+	if ncMode {
+		errOut = os.Stderr
+	}
+
 	// set certificate
 	certData, err := ioutil.ReadFile(certPath)
 	if err != nil {
-		fmt.Println(err)
-		return
+		fmt.Fprintln(errOut, err)
+		return 1
 	}
 	block, _ := pem.Decode(certData)
 	if block == nil {
-		fmt.Println("invalid PEM block")
-		return
+		fmt.Fprintln(errOut, "invalid PEM block")
+		return 1
 	}
 	if block.Type != "CERTIFICATE" {
-		fmt.Println("invalid PEM block type")
-		return
+		fmt.Fprintln(errOut, "invalid PEM block type")
+		return 1
 	}
 	cert, err := x509.ParseCertificate(block.Bytes)
 	if err != nil {
-		fmt.Println(err)
-		return
+		fmt.Fprintln(errOut, err)
+		return 1
 	}
 	tlsConfig := tls.Config{RootCAs: x509.NewCertPool()}
 	tlsConfig.RootCAs.AddCert(cert)
 
 	// connect quic-socks server
-	client, err := socks.NewClient(remoteAddr, []byte(password), &tlsConfig)
-	if err != nil {
-		fmt.Println(err)
-		return
+	var client socks.Dialer
+	servers := strings.Split(remoteAddr, ",")
+	if wsURL != "" {
+		client, err = newWebSocketClient(wsURL, []byte(password), cert)
+		if err != nil {
+			fmt.Fprintln(errOut, err)
+			return 1
+		}
+	} else if len(servers) == 1 {
+		// the weight is useless with one server
+		address, _, err := splitWeight(remoteAddr)
+		if err != nil {
+			fmt.Fprintln(errOut, err)
+			return 1
+		}
+		c, err := socks.NewClient(address, []byte(password), &tlsConfig)
+		if err != nil {
+			fmt.Fprintln(errOut, err)
+			return 1
+		}
+		if tcpPort != "" {
+			c.SetTCPFallback(&socks.TCPFallbackOptions{Address: tcpAddress(address, tcpPort)})
+		}
+		client = c
+	} else {
+		opts := socks.BalancerOptions{ProbeInterval: probe}
+		opts.Strategy, err = socks.ParseStrategy(strategy)
+		if err != nil {
+			fmt.Fprintln(errOut, err)
+			return 1
+		}
+		upstreams := make([]*socks.Upstream, len(servers))
+		for i, server := range servers {
+			address, weight, err := splitWeight(server)
+			if err != nil {
+				fmt.Fprintln(errOut, err)
+				return 1
+			}
+			upstreams[i] = &socks.Upstream{
+				Address:   address,
+				Weight:    weight,
+				Password:  []byte(password),
+				TLSConfig: &tlsConfig,
+			}
+			if tcpPort != "" {
+				upstreams[i].TCPAddress = tcpAddress(upstreams[i].Address, tcpPort)
+			}
+		}
+		balancer, err := socks.NewBalancer(upstreams, &opts)
+		if err != nil {
+			fmt.Fprintln(errOut, err)
+			return 1
+		}
+		defer balancer.Close()
+		client = balancer
+	}
+
+	if ncMode {
+		log.SetOutput(ioutil.Discard)
+		return netcat(client, flag.Args()[1:], os.Stdin, os.Stdout, os.Stderr, &relayOpts)
 	}
 
 	// accept client conn
 	listener, err := net.Listen("tcp", localAddr)
 	if err != nil {
 		fmt.Println(err)
-		return
+		return 1
 	}
 
 	log.SetOutput(ioutil.Discard)
 
-	wg := sync.WaitGroup{}
-	// start pre-connected worker
-	stopSignal := make(chan struct{})
-	connQueue := make(chan net.Conn, preConns)
-	for i := 0; i < preConns/10+1; i++ {
-		wg.Add(1)
-		go func() {
-			defer wg.Done()
-			for {
-				select {
-				case <-stopSignal:
-					return
-				default:
-				}
-				conn, err := client.Dial()
-				if err != nil {
-					fmt.Println("failed to dial quic socks:", err)
-					time.Sleep(time.Second)
-					continue
-				}
-				select {
-				case connQueue <- conn:
-				case <-stopSignal:
-					return
-				}
-			}
-		}()
+	// start pre-connection pool
+	pool := socks.NewPool(client, &socks.PoolOptions{
+		MaxSize: preConns,
+		MaxAge:  preAge,
+		OnDialError: func(err error) {
+			fmt.Println("failed to dial quic socks:", err)
+		},
+	})
+
+	h := handler{
+		pool:  pool,
+		fast:  fast,
+		wait:  fastWait,
+		bound: bound,
+		relay: &relayOpts,
+		users: make(map[string][]byte),
+	}
+	if usersPath != "" {
+		h.users, err = loadUsers(usersPath)
+		if err != nil {
+			fmt.Println(err)
+			return 1
+		}
+	}
+	if socksUser != "" && socksPwd != "" {
+		h.users[socksUser] = []byte(socksPwd)
+	}
+	if pipeline {
+		h.pipeliner = client.(dialConnector)
+	}
+
+	// start DNS forwarder
+	var forwarder *dnsForwarder
+	if dnsAddr != "" {
+		forwarder, err = newDNSForwarder(pool, dnsAddr)
+		if err != nil {
+			fmt.Println(err)
+			return 1
+		}
+	}
+
+	// start local forwards
+	var fwd *portForwarder
+	if len(forwards) != 0 {
+		fwd, err = newPortForwarder(&h, forwards)
+		if err != nil {
+			fmt.Println(err)
+			return 1
+		}
+	}
+
+	// start reverse tunnels
+	var rev *reverser
+	if len(reverses) != 0 {
+		rev = newReverser(client, reverses, &relayOpts)
 	}
 
 	// handle signal
+	wg := sync.WaitGroup{}
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
 		signalChan := make(chan os.Signal, 1)
 		signal.Notify(signalChan, os.Kill, os.Interrupt)
 		<-signalChan
-		close(stopSignal)
 		_ = listener.Close()
+		pool.Close()
+		if forwarder != nil {
+			forwarder.Close()
+		}
+		if fwd != nil {
+			fwd.Close()
+		}
+		if rev != nil {
+			rev.Close()
+		}
 	}()
 
-	socksUserBytes := []byte(socksUser)
-	socksPwdBytes := []byte(socksPwd)
-
 	// handle conn
 	var tempDelay time.Duration
 	max := time.Second
@@ -144,22 +294,24 @@ func main() {
 			break
 		}
 		tempDelay = 0
-		go handleConn(connQueue, conn, socksUserBytes, socksPwdBytes)
+		go h.handleConn(conn)
 	}
 	wg.Wait()
+	return 0
 }
 
 const (
 	version5 uint8 = 0x05
 	reserve  uint8 = 0x00
 	// auth method
+	notRequired      uint8 = 0x00
 	usernamePassword uint8 = 0x02
+	noAcceptable     uint8 = 0xFF
 
 	// auth
 	usernamePasswordVersion uint8 = 0x01
 	statusSucceeded         uint8 = 0x00
 	statusFailed            uint8 = 0x01
-	notRequired             uint8 = 0x00
 	// cmd
 	connect uint8 = 0x01
 	// address
@@ -167,85 +319,202 @@ const (
 	fqdn uint8 = 0x03
 	ipv6 uint8 = 0x04
 	// reply
-	succeeded   uint8 = 0x00
-	connRefused uint8 = 0x05
+	succeeded      uint8 = 0x00
+	generalFailure uint8 = 0x01
 )
 
-var (
-	success    = []byte{version5, succeeded, reserve, ipv4, 0, 0, 0, 0, 0, 0}
-	connRefuse = []byte{version5, connRefused, reserve, ipv4, 0, 0, 0, 0, 0, 0}
-)
+// reply is used to build the reply with the bound address,
+// if bound is nil, it will be padding ipv4 + 0.0.0.0 + 0(port).
+func reply(code uint8, bound *socks.Addr) []byte {
+	b := []byte{version5, code, reserve}
+	switch {
+	case bound == nil:
+		b = append(b, ipv4, 0, 0, 0, 0)
+	case bound.Type() == socks.AddrIPv4:
+		b = append(b, ipv4)
+		b = append(b, bound.IP.To4()...)
+	case bound.Type() == socks.AddrIPv6:
+		b = append(b, ipv6)
+		b = append(b, bound.IP.To16()...)
+	default:
+		b = append(b, fqdn, byte(len(bound.FQDN)))
+		b = append(b, bound.FQDN...)
+	}
+	port := make([]byte, 2)
+	if bound != nil {
+		binary.BigEndian.PutUint16(port, bound.Port)
+	}
+	return append(b, port...)
+}
 
-func authenticate(conn net.Conn, su, sp []byte) bool {
-	var err error
-	if len(su) != 0 && len(sp) != 0 {
-		_, err = conn.Write([]byte{version5, usernamePassword})
-		if err != nil {
-			return false
-		}
-		buf := make([]byte, 16)
-		// read username and password version
-		_, err = io.ReadAtLeast(conn, buf[:1], 1)
-		if err != nil {
-			return false
-		}
-		if buf[0] != usernamePasswordVersion {
-			return false
-		}
-		// read username length
-		_, err = io.ReadAtLeast(conn, buf[:1], 1)
-		if err != nil {
-			return false
-		}
-		l := int(buf[0])
-		if l > len(buf) {
-			buf = make([]byte, l)
-		}
-		// read username
-		_, err = io.ReadAtLeast(conn, buf[:l], l)
-		if err != nil {
-			return false
-		}
-		username := make([]byte, l)
-		copy(username, buf[:l])
-		// read password length
-		_, err = io.ReadAtLeast(conn, buf[:1], 1)
-		if err != nil {
-			return false
-		}
-		l = int(buf[0])
-		if l > len(buf) {
-			buf = make([]byte, l)
-		}
-		// read password
-		_, err = io.ReadAtLeast(conn, buf[:l], l)
-		if err != nil {
-			return false
+// splitWeight is used to split "host:port=weight", the weight
+// is 0 if it is omitted.
+func splitWeight(server string) (string, int, error) {
+	i := strings.LastIndex(server, "=")
+	if i == -1 {
+		return server, 0, nil
+	}
+	weight, err := strconv.Atoi(server[i+1:])
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid weight: %s", err)
+	}
+	return server[:i], weight, nil
+}
+
+// newWebSocketClient is used to create the client with the WebSocket
+// transport, the certificate of the server is added to the system
+// certificates, because the CDN uses the public certificate.
+func newWebSocketClient(rawURL string, password []byte, cert *x509.Certificate) (*socks.Client, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	opts := socks.WebSocketOptions{Path: u.Path}
+	var port string
+	switch u.Scheme {
+	case "ws":
+		opts.Plain = true
+		port = "80"
+	case "wss":
+		port = "443"
+	default:
+		return nil, fmt.Errorf("unsupported WebSocket scheme \"%s\"", u.Scheme)
+	}
+	address := u.Host
+	if u.Port() == "" {
+		address = net.JoinHostPort(u.Hostname(), port)
+	}
+	rootCAs, err := x509.SystemCertPool()
+	if err != nil {
+		rootCAs = x509.NewCertPool()
+	}
+	rootCAs.AddCert(cert)
+	tlsConfig := tls.Config{RootCAs: rootCAs}
+	transport := socks.NewWebSocketTransport(&opts)
+	return socks.NewClientWithTransport(transport, address, password, &tlsConfig)
+}
+
+// tcpAddress is used to replace the port about the server address.
+func tcpAddress(address, port string) string {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		host = address
+	}
+	return net.JoinHostPort(host, port)
+}
+
+// loadUsers is used to load the users about local socks server,
+// empty lines and lines start with "#" are ignored.
+func loadUsers(path string) (map[string][]byte, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	users := make(map[string][]byte)
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
 		}
-		password := make([]byte, l)
-		copy(password, buf[:l])
-		// write username password version
-		_, err = conn.Write([]byte{usernamePasswordVersion})
-		if err != nil {
-			return false
+		j := strings.Index(line, ":")
+		if j < 1 || j == len(line)-1 {
+			return nil, fmt.Errorf("invalid user at line %d in %s", i+1, path)
 		}
-		if subtle.ConstantTimeCompare(su, username) != 1 ||
-			subtle.ConstantTimeCompare(sp, password) != 1 {
-			_, _ = conn.Write([]byte{statusFailed})
-			return false
+		username, password := line[:j], line[j+1:]
+		if len(username) > 255 || len(password) > 255 {
+			return nil, fmt.Errorf("username or password too long at line %d in %s", i+1, path)
 		}
-		_, err = conn.Write([]byte{statusSucceeded})
-	} else {
-		_, err = conn.Write([]byte{version5, notRequired})
+		users[username] = []byte(password)
+	}
+	return users, nil
+}
+
+// authenticate is used to select the method from the methods offered
+// by the client, if users are set, username/password is required.
+func (h *handler) authenticate(conn net.Conn, methods []byte) bool {
+	want := notRequired
+	if len(h.users) != 0 {
+		want = usernamePassword
+	}
+	method := noAcceptable
+	if bytes.IndexByte(methods, want) != -1 {
+		method = want
+	}
+	_, err := conn.Write([]byte{version5, method})
+	if err != nil {
+		return false
+	}
+	switch method {
+	case notRequired:
+		return true
+	case usernamePassword:
+		return h.checkUser(conn)
+	default:
+		fmt.Println("no acceptable authentication methods")
+		return false
+	}
+}
+
+// checkUser is the username/password authentication(RFC 1929).
+func (h *handler) checkUser(conn net.Conn) bool {
+	buf := make([]byte, 256)
+	// read username and password version
+	_, err := io.ReadFull(conn, buf[:1])
+	if err != nil {
+		return false
+	}
+	if buf[0] != usernamePasswordVersion {
+		return false
+	}
+	// read username
+	_, err = io.ReadFull(conn, buf[:1])
+	if err != nil {
+		return false
+	}
+	l := int(buf[0])
+	_, err = io.ReadFull(conn, buf[:l])
+	if err != nil {
+		return false
 	}
+	username := string(buf[:l])
+	// read password
+	_, err = io.ReadFull(conn, buf[:1])
 	if err != nil {
 		return false
 	}
-	return true
+	l = int(buf[0])
+	_, err = io.ReadFull(conn, buf[:l])
+	if err != nil {
+		return false
+	}
+	password, ok := h.users[username]
+	if !ok || subtle.ConstantTimeCompare(password, buf[:l]) != 1 {
+		_, _ = conn.Write([]byte{usernamePasswordVersion, statusFailed})
+		fmt.Printf("invalid username or password about \"%s\"\n", username)
+		return false
+	}
+	_, err = conn.Write([]byte{usernamePasswordVersion, statusSucceeded})
+	return err == nil
+}
+
+// dialConnector is implemented by socks.Client and socks.Balancer.
+type dialConnector interface {
+	DialConnect(host string, port uint16, payload []byte) (net.Conn, error)
+	DialConnectBound(addr net.Addr, payload []byte) (net.Conn, *socks.Addr, error)
+}
+
+type handler struct {
+	pool      *socks.Pool
+	pipeliner dialConnector // nil if pipeline is disabled
+	fast      bool
+	wait      time.Duration // wait the first bytes in fast mode
+	bound     bool          // reply the bound address reported by the server
+	relay     *socks.RelayOptions
+	users     map[string][]byte // socks5 username -> password
 }
 
 // simple socks5 server, handle socks5 client
-func handleConn(queue chan net.Conn, conn net.Conn, su, sp []byte) {
+func (h *handler) handleConn(conn net.Conn) {
 	defer func() {
 		if r := recover(); r != nil {
 			fmt.Println("panic:", r)
@@ -265,20 +534,21 @@ func handleConn(queue chan net.Conn, conn net.Conn, su, sp []byte) {
 		fmt.Printf("unexpected protocol version %d\n", buffer[0])
 		return
 	}
-	authNum := int64(buffer[1])
-	if authNum == 0 {
+	methodNum := int(buffer[1])
+	if methodNum == 0 {
 		fmt.Println("authentication methods number is 0")
 		return
 	}
 
-	// read authentication methods(discard)
-	_, err = io.Copy(ioutil.Discard, io.LimitReader(conn, authNum))
+	// read authentication methods
+	methods := make([]byte, methodNum)
+	_, err = io.ReadFull(conn, methods)
 	if err != nil {
 		fmt.Println("read authentication methods failed:", err)
 		return
 	}
 
-	if !authenticate(conn, su, sp) {
+	if !h.authenticate(conn, methods) {
 		return
 	}
 
@@ -300,7 +570,7 @@ func handleConn(queue chan net.Conn, conn net.Conn, su, sp []byte) {
 	// buffer[2] is reserve
 
 	// read address
-	var host string
+	addr := socks.Addr{}
 	switch buffer[3] {
 	case ipv4:
 		_, err = io.ReadAtLeast(conn, buffer[:net.IPv4len], net.IPv4len)
@@ -308,14 +578,14 @@ func handleConn(queue chan net.Conn, conn net.Conn, su, sp []byte) {
 			fmt.Println("read IPv4 failed:", err)
 			return
 		}
-		host = net.IP(buffer[:4]).String()
+		addr.IP = net.IP(append([]byte(nil), buffer[:net.IPv4len]...))
 	case ipv6:
 		_, err = io.ReadAtLeast(conn, buffer[:net.IPv6len], net.IPv6len)
 		if err != nil {
 			fmt.Println("read IPv6 failed:", err)
 			return
 		}
-		host = "[" + net.IP(buffer[:net.IPv6len]).String() + "]"
+		addr.IP = net.IP(append([]byte(nil), buffer[:net.IPv6len]...))
 	case fqdn:
 		// get FQDN length
 		_, err = io.ReadAtLeast(conn, buffer[:1], 1)
@@ -332,9 +602,9 @@ func handleConn(queue chan net.Conn, conn net.Conn, su, sp []byte) {
 			fmt.Println("read FQDN failed:", err)
 			return
 		}
-		host = string(buffer[:l])
+		addr.FQDN = string(buffer[:l])
 	default:
-		fmt.Printf("address type not supported %d\n", buffer[0])
+		fmt.Printf("address type not supported %d\n", buffer[3])
 		return
 	}
 
@@ -344,43 +614,151 @@ func handleConn(queue chan net.Conn, conn net.Conn, su, sp []byte) {
 		fmt.Println("read port failed:", err)
 		return
 	}
+	addr.Port = binary.BigEndian.Uint16(buffer[:2])
 
 	// start connect to quic-socks server
-	port := binary.BigEndian.Uint16(buffer[:2])
-	var remote net.Conn
-startCopy:
-	for {
-		select {
-		case preConn := <-queue:
-			remote, err = socks.Connect(preConn, host, port)
-			if err != nil {
-				_ = preConn.Close()
-				errStr := err.Error()
-				if strings.Contains(errStr, "invalid password") ||
-					strings.Contains(errStr, "failed to connect target") {
-					_, _ = conn.Write(connRefuse)
-					fmt.Println(errStr)
-					return
-				}
-				continue
+	var (
+		remote    net.Conn
+		boundAddr *socks.Addr
+	)
+	if h.fast {
+		// reply success first, the failure will be a connection reset,
+		// the bound address is unknown before connected, so it is not
+		// requested even if -bound is set
+		_, err = conn.Write(reply(succeeded, nil))
+		if err != nil {
+			fmt.Println("failed to write reply:", err)
+			return
+		}
+		var payload []byte
+		if h.wait > 0 && !serverFirst[addr.Port] {
+			payload = readPayload(conn, h.wait)
+		}
+		remote, _, err = h.connect(&addr, payload, false)
+		if err != nil {
+			if tc, ok := conn.(*net.TCPConn); ok {
+				_ = tc.SetLinger(0)
 			}
-			break startCopy
-		case <-time.After(30 * time.Second):
-			fmt.Println("get pre-connection timeout")
+			fmt.Println("failed to connect:", err)
+			return
+		}
+		defer func() { _ = remote.Close() }()
+	} else {
+		remote, boundAddr, err = h.connect(&addr, nil, h.bound)
+		if err != nil {
+			code := generalFailure
+			if resp, ok := err.(socks.Response); ok {
+				code = resp.SOCKS5Reply()
+			}
+			_, _ = conn.Write(reply(code, nil))
+			fmt.Println("failed to connect:", err)
+			return
+		}
+		defer func() { _ = remote.Close() }()
+		_, err = conn.Write(reply(succeeded, boundAddr))
+		if err != nil {
+			fmt.Println("failed to write reply:", err)
 			return
 		}
-	}
-	defer func() { _ = remote.Close() }()
-	// write reply
-	// padding ipv4 + 0.0.0.0 + 0(port)
-	_, err = conn.Write(success)
-	if err != nil {
-		fmt.Println("failed to write reply:", err)
-		return
 	}
 	// copy
 	_ = conn.SetDeadline(time.Time{})
 	_ = remote.SetDeadline(time.Time{})
-	go func() { _, _ = io.Copy(conn, remote) }()
-	_, _ = io.Copy(remote, conn)
+	result := socks.Relay(conn, remote, h.relay)
+	if result.Reason != socks.CloseEOF {
+		fmt.Printf("relay %s closed: %s(%s) upload %d download %d\n",
+			&addr, result.Reason, result.Err, result.Upload, result.Download)
+	}
+}
+
+// connect is used to send the connect request with the initial payload,
+// the bound address is nil if it is not requested.
+func (h *handler) connect(addr *socks.Addr, payload []byte, bound bool) (net.Conn, *socks.Addr, error) {
+	// if no pre-connection is available, dial with the pipelined request
+	if h.pipeliner != nil {
+		preConn := h.pool.TryGet()
+		if preConn == nil {
+			if bound {
+				return h.pipeliner.DialConnectBound(addr, payload)
+			}
+			remote, err := h.pipeliner.DialConnect(addr.Host(), addr.Port, payload)
+			return remote, nil, err
+		}
+		remote, boundAddr, err := connectWith(preConn, addr, payload, bound)
+		if err == nil {
+			return remote, boundAddr, nil
+		}
+		if _, ok := err.(socks.Response); ok {
+			return nil, nil, err
+		}
+	}
+	var (
+		remote    net.Conn
+		boundAddr *socks.Addr
+	)
+	err := connectPool(h.pool, func(preConn net.Conn) error {
+		var err error
+		remote, boundAddr, err = connectWith(preConn, addr, payload, bound)
+		return err
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return remote, boundAddr, nil
+}
+
+// connectWith is used to send the connect request with an authenticated conn.
+func connectWith(conn net.Conn, addr *socks.Addr, payload []byte,
+	bound bool) (net.Conn, *socks.Addr, error) {
+	if bound {
+		return socks.ConnectBound(conn, addr, payload)
+	}
+	remote, err := socks.ConnectWithPayload(conn, addr.Host(), addr.Port, payload)
+	return remote, nil, err
+}
+
+// connectPool is used to send the request by connect with the pre-connection
+// from the pool, the pooled connection may be closed by the server, so it
+// retries unless the error is the response from the server.
+func connectPool(pool *socks.Pool, connect func(preConn net.Conn) error) error {
+	var err error
+	for i := 0; i < 3; i++ {
+		var preConn net.Conn
+		preConn, err = pool.Get()
+		if err != nil {
+			return err
+		}
+		err = connect(preConn)
+		if err == nil {
+			return nil
+		}
+		if _, ok := err.(socks.Response); ok {
+			return err
+		}
+	}
+	return err
+}
+
+// serverFirst contains the well-known ports that the server speaks first,
+// the application will not send the first bytes before the server.
+var serverFirst = map[uint16]bool{
+	21:   true, // FTP
+	22:   true, // SSH
+	23:   true, // Telnet
+	25:   true, // SMTP
+	110:  true, // POP3
+	143:  true, // IMAP
+	587:  true, // SMTP submission
+	3306: true, // MySQL
+	5900: true, // VNC
+}
+
+// readPayload is used to read the first bytes sent by the application,
+// if the application is waiting for the server, it returns nil.
+func readPayload(conn net.Conn, wait time.Duration) []byte {
+	_ = conn.SetReadDeadline(time.Now().Add(wait))
+	defer func() { _ = conn.SetReadDeadline(time.Now().Add(time.Minute)) }()
+	buf := make([]byte, 16*1024)
+	n, _ := conn.Read(buf)
+	return buf[:n]
 }
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/For-ACGN/quic-socks"
+)
+
+func TestHandler_Connect(t *testing.T) {
+	echo, host, port := testEcho(t)
+	defer func() { _ = echo.Close() }()
+	server, client := testServer(t)
+	defer server.Close()
+	pool := socks.NewPool(client, nil)
+	defer pool.Close()
+	p, err := strconv.ParseUint(port, 10, 16)
+	require.NoError(t, err)
+	addr, err := socks.NewAddr(host, uint16(p))
+	require.NoError(t, err)
+
+	// the bound address is only requested if bound is true,
+	// the fast mode doesn't request it with -bound
+	for _, pipeline := range []bool{false, true} {
+		h := handler{pool: pool, bound: true}
+		if pipeline {
+			h.pipeliner = client
+		}
+		remote, boundAddr, err := h.connect(addr, nil, true)
+		require.NoError(t, err)
+		require.NotNil(t, boundAddr)
+		_ = remote.Close()
+
+		remote, boundAddr, err = h.connect(addr, nil, false)
+		require.NoError(t, err)
+		require.Nil(t, boundAddr)
+		_ = remote.Close()
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/For-ACGN/quic-socks"
+)
+
+// dnsForwarder is used to forward DNS queries from local
+// UDP and TCP listeners to the quic-socks server.
+type dnsForwarder struct {
+	pool *socks.Pool
+
+	udpConn     net.PacketConn
+	tcpListener net.Listener
+
+	// idle connections in remote DNS mode
+	conns chan net.Conn
+	wg    sync.WaitGroup
+}
+
+func newDNSForwarder(pool *socks.Pool, address string) (*dnsForwarder, error) {
+	udpConn, err := net.ListenPacket("udp", address)
+	if err != nil {
+		return nil, err
+	}
+	tcpListener, err := net.Listen("tcp", address)
+	if err != nil {
+		_ = udpConn.Close()
+		return nil, err
+	}
+	f := dnsForwarder{
+		pool:        pool,
+		udpConn:     udpConn,
+		tcpListener: tcpListener,
+		conns:       make(chan net.Conn, 16),
+	}
+	f.wg.Add(2)
+	go f.serveUDP()
+	go f.serveTCP()
+	return &f, nil
+}
+
+func (f *dnsForwarder) getConn() (net.Conn, error) {
+	select {
+	case conn := <-f.conns:
+		return conn, nil
+	default:
+	}
+	var conn net.Conn
+	err := connectPool(f.pool, func(preConn net.Conn) error {
+		var err error
+		conn, err = socks.ConnectDNS(preConn)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
+func (f *dnsForwarder) putConn(conn net.Conn) {
+	select {
+	case f.conns <- conn:
+	default:
+		_ = conn.Close()
+	}
+}
+
+func (f *dnsForwarder) exchange(query []byte) ([]byte, error) {
+	conn, err := f.getConn()
+	if err != nil {
+		return nil, err
+	}
+	_ = conn.SetDeadline(time.Now().Add(10 * time.Second))
+	resp, err := socks.ExchangeDNS(conn, query)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	_ = conn.SetDeadline(time.Time{})
+	f.putConn(conn)
+	return resp, nil
+}
+
+func (f *dnsForwarder) serveUDP() {
+	defer f.wg.Done()
+	buf := make([]byte, 65535)
+	for {
+		n, addr, err := f.udpConn.ReadFrom(buf)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				continue
+			}
+			return
+		}
+		query := make([]byte, n)
+		copy(query, buf[:n])
+		go func() {
+			resp, err := f.exchange(query)
+			if err != nil {
+				fmt.Println("failed to exchange DNS message:", err)
+				return
+			}
+			_, _ = f.udpConn.WriteTo(resp, addr)
+		}()
+	}
+}
+
+func (f *dnsForwarder) serveTCP() {
+	defer f.wg.Done()
+	for {
+		conn, err := f.tcpListener.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				time.Sleep(10 * time.Millisecond)
+				continue
+			}
+			return
+		}
+		go f.handleTCPConn(conn)
+	}
+}
+
+func (f *dnsForwarder) handleTCPConn(conn net.Conn) {
+	defer func() { _ = conn.Close() }()
+	for {
+		_ = conn.SetDeadline(time.Now().Add(time.Minute))
+		query, err := socks.ReadDNSMessage(conn)
+		if err != nil {
+			return
+		}
+		resp, err := f.exchange(query)
+		if err != nil {
+			fmt.Println("failed to exchange DNS message:", err)
+			return
+		}
+		err = socks.WriteDNSMessage(conn, resp)
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (f *dnsForwarder) Close() {
+	_ = f.udpConn.Close()
+	_ = f.tcpListener.Close()
+	f.wg.Wait()
+	for {
+		select {
+		case conn := <-f.conns:
+			_ = conn.Close()
+		default:
+			return
+		}
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/For-ACGN/quic-socks"
+)
+
+// localForward is the local forward like "ssh -L [bind:]port:host:hostport".
+type localForward struct {
+	local  string
+	target *socks.Addr
+}
+
+// forwardFlag is used to set multiple local forwards.
+type forwardFlag []*localForward
+
+func (f *forwardFlag) String() string {
+	return fmt.Sprint(len(*f), " local forwards")
+}
+
+// Set is used to parse "[bind:]port:host:hostport", the IPv6 address
+// must be enclosed in square brackets, the listener is bound to the
+// loopback if bind is omitted, "*" or empty bind means all interfaces.
+func (f *forwardFlag) Set(value string) error {
+	parts, err := splitForward(value)
+	if err != nil {
+		return err
+	}
+	bind := "localhost"
+	switch len(parts) {
+	case 3:
+	case 4:
+		bind = parts[0]
+		if bind == "*" {
+			bind = ""
+		}
+		parts = parts[1:]
+	default:
+		return fmt.Errorf("invalid local forward \"%s\"", value)
+	}
+	_, err = strconv.ParseUint(parts[0], 10, 16)
+	if err != nil {
+		return fmt.Errorf("invalid local forward port \"%s\"", value)
+	}
+	port, err := strconv.ParseUint(parts[2], 10, 16)
+	if err != nil {
+		return fmt.Errorf("invalid local forward target \"%s\"", value)
+	}
+	target, err := socks.NewAddr(parts[1], uint16(port))
+	if err != nil {
+		return fmt.Errorf("invalid local forward target \"%s\"", value)
+	}
+	forward := localForward{
+		local:  net.JoinHostPort(bind, parts[0]),
+		target: target,
+	}
+	*f = append(*f, &forward)
+	return nil
+}
+
+// splitForward is used to split the value by ":" outside the square
+// brackets, the brackets about the IPv6 address are removed.
+func splitForward(value string) ([]string, error) {
+	var (
+		parts   []string
+		start   int
+		bracket bool
+	)
+	for i := 0; i < len(value); i++ {
+		switch value[i] {
+		case '[':
+			if bracket || i != start {
+				return nil, fmt.Errorf("invalid local forward \"%s\"", value)
+			}
+			bracket = true
+		case ']':
+			if !bracket || (i+1 != len(value) && value[i+1] != ':') {
+				return nil, fmt.Errorf("invalid local forward \"%s\"", value)
+			}
+			bracket = false
+		case ':':
+			if !bracket {
+				parts = append(parts, strings.Trim(value[start:i], "[]"))
+				start = i + 1
+			}
+		}
+	}
+	if bracket {
+		return nil, fmt.Errorf("invalid local forward \"%s\"", value)
+	}
+	return append(parts, strings.Trim(value[start:], "[]")), nil
+}
+
+func (f *localForward) String() string {
+	return f.target.String()
+}
+
+// portForwarder is used to send the connections accepted by the local
+// listeners to the fixed targets, without the socks5 negotiation, the
+// connect request is sent by the handler, so -pipeline works.
+type portForwarder struct {
+	handler *handler
+
+	listeners []net.Listener
+	wg        sync.WaitGroup
+}
+
+func newPortForwarder(h *handler, forwards []*localForward) (*portForwarder, error) {
+	f := portForwarder{handler: h}
+	for _, forward := range forwards {
+		listener, err := net.Listen("tcp", forward.local)
+		if err != nil {
+			for _, l := range f.listeners {
+				_ = l.Close()
+			}
+			return nil, err
+		}
+		f.listeners = append(f.listeners, listener)
+	}
+	for i, listener := range f.listeners {
+		fmt.Printf("local forward %s -> %s\n", listener.Addr(), forwards[i])
+		f.wg.Add(1)
+		go f.serve(listener, forwards[i])
+	}
+	return &f, nil
+}
+
+func (f *portForwarder) serve(listener net.Listener, forward *localForward) {
+	defer f.wg.Done()
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				time.Sleep(time.Second)
+				continue
+			}
+			return
+		}
+		go f.handleConn(conn, forward)
+	}
+}
+
+func (f *portForwarder) handleConn(conn net.Conn, forward *localForward) {
+	defer func() { _ = conn.Close() }()
+	remote, _, err := f.handler.connect(forward.target, nil, false)
+	if err != nil {
+		fmt.Printf("failed to connect %s: %s\n", forward, err)
+		return
+	}
+	defer func() { _ = remote.Close() }()
+	_ = remote.SetDeadline(time.Time{})
+	result := socks.Relay(conn, remote, f.handler.relay)
+	if result.Reason != socks.CloseEOF {
+		fmt.Printf("forward %s closed: %s(%s) upload %d download %d\n",
+			forward, result.Reason, result.Err, result.Upload, result.Download)
+	}
+}
+
+func (f *portForwarder) Close() {
+	for _, listener := range f.listeners {
+		_ = listener.Close()
+	}
+	f.wg.Wait()
+}
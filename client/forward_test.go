@@ -0,0 +1,88 @@
+package main
+
+import (
+	"io"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/For-ACGN/quic-socks"
+)
+
+func TestForwardFlag(t *testing.T) {
+	for _, item := range []struct {
+		value string
+		local string
+		host  string
+		port  uint16
+	}{
+		{"5432:db.internal:5432", "localhost:5432", "db.internal", 5432},
+		{"127.0.0.1:5432:db.internal:5433", "127.0.0.1:5432", "db.internal", 5433},
+		{"*:5432:db.internal:5432", ":5432", "db.internal", 5432},
+		{"0.0.0.0:5432:10.0.0.5:5432", "0.0.0.0:5432", "10.0.0.5", 5432},
+		{"[::1]:5432:[fd00::5]:5432", "[::1]:5432", "fd00::5", 5432},
+		{"5432:[fd00::5]:5432", "localhost:5432", "fd00::5", 5432},
+	} {
+		var flag forwardFlag
+		require.NoError(t, flag.Set(item.value), item.value)
+		require.Equal(t, item.local, flag[0].local, item.value)
+		require.Equal(t, item.host, flag[0].target.Host(), item.value)
+		require.Equal(t, item.port, flag[0].target.Port, item.value)
+	}
+
+	for _, value := range []string{
+		"",
+		"5432",
+		"5432:db.internal",
+		"foo:db.internal:5432",
+		"5432:db.internal:foo",
+		"5432::5432",
+		"::1:5432:db.internal:5432",
+		"[::1:5432:db.internal:5432",
+		"[::1]x:5432:db.internal:5432",
+		"a:b:5432:db.internal:5432",
+	} {
+		var flag forwardFlag
+		require.Error(t, flag.Set(value), value)
+	}
+}
+
+func TestPortForwarder(t *testing.T) {
+	echo, host, port := testEcho(t)
+	defer func() { _ = echo.Close() }()
+	server, client := testServer(t)
+	defer server.Close()
+	pool := socks.NewPool(client, nil)
+	defer pool.Close()
+
+	for _, item := range []struct {
+		name     string
+		pipeline bool
+	}{
+		{"pool", false},
+		{"pipeline", true},
+	} {
+		t.Run(item.name, func(t *testing.T) {
+			h := handler{pool: pool}
+			if item.pipeline {
+				h.pipeliner = client
+			}
+			var flag forwardFlag
+			require.NoError(t, flag.Set("0:"+host+":"+port))
+			fwd, err := newPortForwarder(&h, flag)
+			require.NoError(t, err)
+			defer fwd.Close()
+
+			conn, err := net.Dial("tcp", fwd.listeners[0].Addr().String())
+			require.NoError(t, err)
+			defer func() { _ = conn.Close() }()
+			_, err = conn.Write([]byte("hello"))
+			require.NoError(t, err)
+			buf := make([]byte, 5)
+			_, err = io.ReadFull(conn, buf)
+			require.NoError(t, err)
+			require.Equal(t, "hello", string(buf))
+		})
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/For-ACGN/quic-socks"
+)
+
+// netcat is used to connect the target and relay stdin/stdout,
+// it can be used as the ProxyCommand of ssh like
+// "ssh -o ProxyCommand='client nc %h %p'", stdout is the
+// data stream, so the errors are printed to stderr, it
+// returns the exit code.
+func netcat(dialer socks.Dialer, args []string, stdin io.Reader, stdout io.Writer,
+	stderr io.Writer, relay *socks.RelayOptions) int {
+	if len(args) != 2 {
+		fmt.Fprintln(stderr, "usage: client [flags] nc host port")
+		return 2
+	}
+	port, err := strconv.ParseUint(args[1], 10, 16)
+	if err != nil {
+		fmt.Fprintf(stderr, "invalid port \"%s\"\n", args[1])
+		return 2
+	}
+	conn, err := dialer.Dial()
+	if err != nil {
+		fmt.Fprintln(stderr, "failed to dial quic socks:", err)
+		return 1
+	}
+	remote, err := socks.Connect(conn, args[0], uint16(port))
+	if err != nil {
+		fmt.Fprintln(stderr, "failed to connect:", err)
+		return 1
+	}
+	defer func() { _ = remote.Close() }()
+	_ = remote.SetDeadline(time.Time{})
+	stdio := newStdioConn(stdin, stdout)
+	defer func() { _ = stdio.Close() }()
+	result := socks.Relay(stdio, remote, relay)
+	if result.Reason != socks.CloseEOF {
+		fmt.Fprintf(stderr, "relay closed: %s(%s) upload %d download %d\n",
+			result.Reason, result.Err, result.Upload, result.Download)
+		return 1
+	}
+	return 0
+}
+
+// stdioConn is used to make stdin and stdout as a net.Conn for
+// socks.Relay, stdin is read by a goroutine with a pipe, so the
+// blocked Read can be interrupted by Close when the relay is
+// aborted, the goroutine exits with the process.
+type stdioConn struct {
+	reader *io.PipeReader
+	writer io.Writer
+
+	closeOnce sync.Once
+}
+
+func newStdioConn(stdin io.Reader, stdout io.Writer) *stdioConn {
+	pr, pw := io.Pipe()
+	go func() {
+		_, err := io.Copy(pw, stdin)
+		_ = pw.CloseWithError(err)
+	}()
+	return &stdioConn{
+		reader: pr,
+		writer: stdout,
+	}
+}
+
+func (c *stdioConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+func (c *stdioConn) Write(b []byte) (int, error) {
+	return c.writer.Write(b)
+}
+
+// CloseWrite is used to close stdout for send EOF to the reader.
+func (c *stdioConn) CloseWrite() error {
+	var err error
+	c.closeOnce.Do(func() {
+		if closer, ok := c.writer.(io.Closer); ok {
+			err = closer.Close()
+		}
+	})
+	return err
+}
+
+func (c *stdioConn) Close() error {
+	_ = c.reader.Close()
+	return c.CloseWrite()
+}
+
+func (c *stdioConn) LocalAddr() net.Addr {
+	return stdioAddr{}
+}
+
+func (c *stdioConn) RemoteAddr() net.Addr {
+	return stdioAddr{}
+}
+
+func (c *stdioConn) SetDeadline(time.Time) error {
+	return nil
+}
+
+func (c *stdioConn) SetReadDeadline(time.Time) error {
+	return nil
+}
+
+func (c *stdioConn) SetWriteDeadline(time.Time) error {
+	return nil
+}
+
+type stdioAddr struct{}
+
+func (stdioAddr) Network() string {
+	return "stdio"
+}
+
+func (stdioAddr) String() string {
+	return "stdio"
+}
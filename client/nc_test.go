@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/For-ACGN/quic-socks"
+)
+
+// testServer is used to start a quic-socks server with the testdata
+// certificate and create the client about it.
+func testServer(t *testing.T) (*socks.Server, *socks.Client) {
+	tlsCert, err := tls.LoadX509KeyPair("../testdata/cert.pem", "../testdata/key.pem")
+	require.NoError(t, err)
+	server, err := socks.NewServer("localhost:0", []byte("test"),
+		&tls.Config{Certificates: []tls.Certificate{tlsCert}})
+	require.NoError(t, err)
+	go func() { _ = server.ListenAndServe() }()
+
+	cert, err := x509.ParseCertificate(tlsCert.Certificate[0])
+	require.NoError(t, err)
+	clientTLS := tls.Config{
+		RootCAs:    x509.NewCertPool(),
+		ServerName: "localhost",
+	}
+	clientTLS.RootCAs.AddCert(cert)
+	client, err := socks.NewClient(server.Addr().String(), []byte("test"), &clientTLS)
+	require.NoError(t, err)
+	return server, client
+}
+
+// testEcho is used to start a TCP echo server, it returns the host and port.
+func testEcho(t *testing.T) (net.Listener, string, string) {
+	listener, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer func() { _ = conn.Close() }()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+	host, port, err := net.SplitHostPort(listener.Addr().String())
+	require.NoError(t, err)
+	return listener, host, port
+}
+
+func TestNetcat(t *testing.T) {
+	echo, host, port := testEcho(t)
+	defer func() { _ = echo.Close() }()
+	server, client := testServer(t)
+	defer server.Close()
+
+	t.Run("relay", func(t *testing.T) {
+		stdinR, stdinW := io.Pipe()
+		stdoutR, stdoutW := io.Pipe()
+		stderr := bytes.Buffer{}
+		code := make(chan int, 1)
+		go func() {
+			code <- netcat(client, []string{host, port}, stdinR, stdoutW, &stderr, nil)
+		}()
+
+		_, err := stdinW.Write([]byte("hello"))
+		require.NoError(t, err)
+		buf := make([]byte, 5)
+		_, err = io.ReadFull(stdoutR, buf)
+		require.NoError(t, err)
+		require.Equal(t, "hello", string(buf))
+
+		// EOF of stdin is sent to the target, and the
+		// echo server closes stdout after it
+		require.NoError(t, stdinW.Close())
+		rest, err := ioutil.ReadAll(stdoutR)
+		require.NoError(t, err)
+		require.Empty(t, rest)
+		require.Equal(t, 0, <-code)
+		require.Empty(t, stderr.String())
+	})
+
+	t.Run("idle timeout", func(t *testing.T) {
+		stdinR, stdinW := io.Pipe()
+		defer func() { _ = stdinW.Close() }()
+		stdoutR, stdoutW := io.Pipe()
+		go func() { _, _ = io.Copy(ioutil.Discard, stdoutR) }()
+		stderr := bytes.Buffer{}
+		opts := socks.RelayOptions{IdleTimeout: 100 * time.Millisecond}
+		code := make(chan int, 1)
+		go func() {
+			code <- netcat(client, []string{host, port}, stdinR, stdoutW, &stderr, &opts)
+		}()
+
+		select {
+		case c := <-code:
+			require.Equal(t, 1, c)
+		case <-time.After(10 * time.Second):
+			t.Fatal("idle relay is not closed")
+		}
+		require.Contains(t, stderr.String(), socks.CloseIdle.String())
+	})
+
+	t.Run("usage", func(t *testing.T) {
+		stderr := bytes.Buffer{}
+		code := netcat(client, []string{host}, strings.NewReader(""), ioutil.Discard, &stderr, nil)
+		require.Equal(t, 2, code)
+		require.Contains(t, stderr.String(), "usage")
+
+		stderr.Reset()
+		code = netcat(client, []string{host, "70000"}, strings.NewReader(""), ioutil.Discard, &stderr, nil)
+		require.Equal(t, 2, code)
+		require.Contains(t, stderr.String(), "invalid port")
+	})
+
+	t.Run("connect failed", func(t *testing.T) {
+		listener, err := net.Listen("tcp", "localhost:0")
+		require.NoError(t, err)
+		closed := strconv.Itoa(listener.Addr().(*net.TCPAddr).Port)
+		require.NoError(t, listener.Close())
+
+		stderr := bytes.Buffer{}
+		code := netcat(client, []string{host, closed}, strings.NewReader(""), ioutil.Discard, &stderr, nil)
+		require.Equal(t, 1, code)
+		require.Contains(t, stderr.String(), "failed to connect")
+	})
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/For-ACGN/quic-socks"
+)
+
+// reverseTunnel is the reverse tunnel like "ssh -R port:host:hostport".
+type reverseTunnel struct {
+	port   uint16
+	target string
+}
+
+// reverseFlag is used to set multiple reverse tunnels.
+type reverseFlag []*reverseTunnel
+
+func (r *reverseFlag) String() string {
+	return fmt.Sprint(len(*r), " reverse tunnels")
+}
+
+func (r *reverseFlag) Set(value string) error {
+	i := strings.Index(value, ":")
+	if i == -1 {
+		return fmt.Errorf("invalid reverse tunnel \"%s\"", value)
+	}
+	port, err := strconv.ParseUint(value[:i], 10, 16)
+	if err != nil {
+		return fmt.Errorf("invalid reverse tunnel port \"%s\"", value[:i])
+	}
+	target := value[i+1:]
+	_, _, err = net.SplitHostPort(target)
+	if err != nil {
+		return fmt.Errorf("invalid reverse tunnel target \"%s\"", target)
+	}
+	*r = append(*r, &reverseTunnel{port: uint16(port), target: target})
+	return nil
+}
+
+// reverser is used to keep the reverse tunnels, the tunnel
+// will be registered again after the session is closed.
+type reverser struct {
+	dialer socks.Dialer
+	relay  *socks.RelayOptions
+
+	listeners map[net.Listener]struct{}
+	closed    bool
+	mu        sync.Mutex
+
+	stopSignal chan struct{}
+	wg         sync.WaitGroup
+}
+
+func newReverser(dialer socks.Dialer, tunnels []*reverseTunnel, relay *socks.RelayOptions) *reverser {
+	r := reverser{
+		dialer:     dialer,
+		relay:      relay,
+		listeners:  make(map[net.Listener]struct{}),
+		stopSignal: make(chan struct{}),
+	}
+	for _, tunnel := range tunnels {
+		r.wg.Add(1)
+		go r.serve(tunnel)
+	}
+	return &r
+}
+
+func (r *reverser) serve(tunnel *reverseTunnel) {
+	defer r.wg.Done()
+	delay := time.Second
+	for {
+		listener, err := r.listen(tunnel)
+		if err != nil {
+			fmt.Printf("failed to listen reverse port %d: %s, retrying in %v\n", tunnel.port, err, delay)
+			select {
+			case <-time.After(delay):
+			case <-r.stopSignal:
+				return
+			}
+			if delay *= 2; delay > time.Minute {
+				delay = time.Minute
+			}
+			continue
+		}
+		delay = time.Second
+		fmt.Printf("reverse tunnel %s -> %s\n", listener.Addr(), tunnel.target)
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				break
+			}
+			go r.handleConn(conn, tunnel.target)
+		}
+		if !r.untrack(listener) {
+			return
+		}
+	}
+}
+
+func (r *reverser) listen(tunnel *reverseTunnel) (net.Listener, error) {
+	conn, err := r.dialer.Dial()
+	if err != nil {
+		return nil, err
+	}
+	listener, err := socks.ListenReverse(conn, tunnel.port)
+	if err != nil {
+		return nil, err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		_ = listener.Close()
+		return nil, socks.ErrConnClosed
+	}
+	r.listeners[listener] = struct{}{}
+	return listener, nil
+}
+
+// untrack is used to delete the closed listener, it
+// returns false if the reverser is closed.
+func (r *reverser) untrack(listener net.Listener) bool {
+	_ = listener.Close()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.listeners, listener)
+	return !r.closed
+}
+
+func (r *reverser) handleConn(conn net.Conn, target string) {
+	defer func() { _ = conn.Close() }()
+	remote, err := net.DialTimeout("tcp", target, 30*time.Second)
+	if err != nil {
+		fmt.Printf("failed to connect reverse target %s: %s\n", target, err)
+		return
+	}
+	defer func() { _ = remote.Close() }()
+	result := socks.Relay(conn, remote, r.relay)
+	if result.Reason != socks.CloseEOF {
+		fmt.Printf("reverse %s -> %s closed: %s(%s) upload %d download %d\n",
+			conn.RemoteAddr(), target, result.Reason, result.Err, result.Upload, result.Download)
+	}
+}
+
+func (r *reverser) Close() {
+	r.mu.Lock()
+	r.closed = true
+	for listener := range r.listeners {
+		_ = listener.Close()
+	}
+	r.mu.Unlock()
+	close(r.stopSignal)
+	r.wg.Wait()
+}
@@ -1,89 +1,90 @@
 package socks
 
 import (
+	"crypto/tls"
 	"errors"
+	"io"
+	"io/ioutil"
 	"net"
-	"sync"
 	"time"
-
-	"github.com/lucas-clemente/quic-go"
 )
 
 // ErrConnClosed is an error about closed
 var ErrConnClosed = errors.New("connection closed")
 
-// Conn implement net.Conn
+// Conn implement net.Conn, it is a stream with the session that
+// only carries it, the session will be closed with the Conn.
 type Conn struct {
-	// must close rawConn manually to prevent goroutine leak
-	// in package github.com/lucas-clemente/quic-go
-	// go m.listen() in newPacketHandlerMap()
-	rawConn net.PacketConn
-
-	session quic.Session
-	stream  quic.Stream
-
-	// must use extra Mutex because SendStream
-	// is not safe for use by multiple goroutines
-	//
-	// stream.Close() must not be called concurrently with Write()
-	sendMutex sync.Mutex
-
-	// only server connection need it
-	timeout    time.Duration
-	acceptErr  error
-	acceptOnce sync.Once
-}
-
-func (c *Conn) acceptStream() error {
-	c.acceptOnce.Do(func() {
-		if c.stream == nil {
-			c.stream, c.acceptErr = c.session.AcceptStream()
-			if c.acceptErr != nil {
-				return
-			}
-			// read data for prevent block
-			_ = c.stream.SetReadDeadline(time.Now().Add(c.timeout))
-			_, c.acceptErr = c.stream.Read(make([]byte, 1))
-		}
-	})
-	return c.acceptErr
+	session Session
+	stream  Stream
 }
 
-// Read reads data from the connection
-func (c *Conn) Read(b []byte) (n int, err error) {
-	err = c.acceptStream()
+// dialConn is used to dial the server and open the stream.
+func dialConn(transport Transport, address string, tlsConfig *tls.Config) (*Conn, error) {
+	session, err := transport.Dial(address, tlsConfig)
 	if err != nil {
-		return
+		return nil, err
 	}
+	stream, err := session.OpenStream()
+	if err != nil {
+		_ = session.Close()
+		return nil, err
+	}
+	conn := &Conn{session: session, stream: stream}
+	_ = conn.SetDeadline(time.Now().Add(time.Minute))
+	return conn, nil
+}
+
+// Read reads data from the connection
+func (c *Conn) Read(b []byte) (n int, err error) {
 	return c.stream.Read(b)
 }
 
 // Write writes data to the connection
 func (c *Conn) Write(b []byte) (n int, err error) {
-	err = c.acceptStream()
-	if err != nil {
-		return
-	}
-	c.sendMutex.Lock()
-	defer c.sendMutex.Unlock()
 	return c.stream.Write(b)
 }
 
 // Close is used to close connection
 func (c *Conn) Close() error {
-	c.acceptOnce.Do(func() {
-		c.acceptErr = ErrConnClosed
-	})
-	c.sendMutex.Lock()
-	defer c.sendMutex.Unlock()
-	if c.stream != nil {
-		_ = c.stream.Close()
+	_ = c.stream.Close()
+	return c.session.Close()
+}
+
+// CloseWrite is used to close the write side of the stream, the
+// peer will read io.EOF after all data are read, like TCP FIN.
+func (c *Conn) CloseWrite() error {
+	return c.stream.CloseWrite()
+}
+
+// CloseRead is used to abort reading on the stream, the
+// peer will not be able to write data to the stream.
+func (c *Conn) CloseRead() error {
+	return closeRead(c.stream)
+}
+
+// waitClose is used to wait the peer close the session, it prevents
+// the data not received by the peer are dropped when close the session,
+// the data not read are discarded for prevent the connection reset.
+func (c *Conn) waitClose(timeout time.Duration) {
+	_ = c.stream.SetReadDeadline(time.Now().Add(timeout))
+	go func() { _, _ = io.Copy(ioutil.Discard, c.stream) }()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-c.session.Done():
+	case <-timer.C:
 	}
-	err := c.session.CloseWithError(0, "no error")
-	if c.rawConn != nil {
-		_ = c.rawConn.Close()
+}
+
+// isAlive is used to check the session is not closed.
+func (c *Conn) isAlive() bool {
+	select {
+	case <-c.session.Done():
+		return false
+	default:
+		return true
 	}
-	return err
 }
 
 // LocalAddr is used to get local address
@@ -98,51 +99,31 @@ func (c *Conn) RemoteAddr() net.Addr {
 
 // SetDeadline is used to set read and write deadline
 func (c *Conn) SetDeadline(t time.Time) error {
-	err := c.SetReadDeadline(t)
-	if err != nil {
-		return err
-	}
-	return c.SetWriteDeadline(t)
+	return c.stream.SetDeadline(t)
 }
 
 // SetReadDeadline is used to set read deadline
 func (c *Conn) SetReadDeadline(t time.Time) error {
-	err := c.acceptStream()
-	if err != nil {
-		return err
-	}
 	return c.stream.SetReadDeadline(t)
 }
 
 // SetWriteDeadline is used to set write deadline
 func (c *Conn) SetWriteDeadline(t time.Time) error {
-	err := c.acceptStream()
-	if err != nil {
-		return err
-	}
 	return c.stream.SetWriteDeadline(t)
 }
 
-type listener struct {
-	rawConn net.PacketConn // see Conn
-	quic.Listener
-	timeout time.Duration
-}
-
-func (l *listener) Accept() (net.Conn, error) {
-	session, err := l.Listener.Accept()
-	if err != nil {
-		return nil, err
+// closeWrite is used to close the write side if the conn supports it.
+func closeWrite(conn net.Conn) error {
+	if c, ok := conn.(interface{ CloseWrite() error }); ok {
+		return c.CloseWrite()
 	}
-	conn := Conn{
-		session: session,
-		timeout: l.timeout,
-	}
-	return &conn, nil
+	return nil
 }
 
-func (l *listener) Close() error {
-	err := l.Listener.Close()
-	_ = l.rawConn.Close()
-	return err
+// closeRead is used to close the read side if the conn supports it.
+func closeRead(conn net.Conn) error {
+	if c, ok := conn.(interface{ CloseRead() error }); ok {
+		return c.CloseRead()
+	}
+	return nil
 }
@@ -0,0 +1,368 @@
+package socks
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// IPMode is the IP version preference about outbound connections.
+type IPMode uint8
+
+// IP version preferences.
+const (
+	IPDefault IPMode = iota // resolver order
+	IPv4Only
+	IPv6Only
+	PreferIPv4
+	PreferIPv6
+)
+
+// ParseIPMode is used to parse IPMode from string like "prefer-ipv4".
+func ParseIPMode(mode string) (IPMode, error) {
+	switch mode {
+	case "", "default":
+		return IPDefault, nil
+	case "ipv4":
+		return IPv4Only, nil
+	case "ipv6":
+		return IPv6Only, nil
+	case "prefer-ipv4":
+		return PreferIPv4, nil
+	case "prefer-ipv6":
+		return PreferIPv6, nil
+	default:
+		return 0, errors.Errorf("unknown ip mode \"%s\"", mode)
+	}
+}
+
+// DialOptions contains options about the outbound connections of the server.
+type DialOptions struct {
+	// LocalAddr is the source IP address, the target
+	// addresses must have the same IP version with it
+	LocalAddr string
+
+	// Interface is the network interface that bind to,
+	// it uses SO_BINDTODEVICE and only support Linux
+	Interface string
+
+	IPMode IPMode
+
+	// Timeout is the maximum amount of time a dial will
+	// wait for a connect to complete, default is 30s
+	Timeout time.Duration
+
+	// KeepAlive is the TCP keep-alive period, zero
+	// is the default(15s), negative will disable it
+	KeepAlive time.Duration
+
+	// FallbackDelay is the Happy Eyeballs delay before
+	// try the other IP version, zero is the default(300ms),
+	// negative will disable Happy Eyeballs and dial serially
+	FallbackDelay time.Duration
+
+	// Resolver is used to resolve FQDN target,
+	// if it is nil, the system resolver will be used
+	Resolver *Resolver
+
+	// Routes are used to connect targets through upstream
+	// proxies, the first matched route will be used, if no
+	// route is matched, the target will be connected directly,
+	// if the acl has IP rules, the FQDN target is resolved and
+	// checked, then the proxy connects the IP address
+	Routes []*Route
+}
+
+type dialer struct {
+	resolver      *Resolver
+	mode          IPMode
+	timeout       time.Duration
+	fallbackDelay time.Duration
+	netDialer     *net.Dialer
+	routes        []*route
+}
+
+func newDialer(opts *DialOptions) (*dialer, error) {
+	if opts == nil {
+		opts = new(DialOptions)
+	}
+	d := dialer{
+		resolver:      opts.Resolver,
+		mode:          opts.IPMode,
+		timeout:       opts.Timeout,
+		fallbackDelay: opts.FallbackDelay,
+		netDialer:     &net.Dialer{KeepAlive: opts.KeepAlive},
+	}
+	if d.resolver == nil {
+		d.resolver, _ = NewResolver(nil)
+	}
+	if d.timeout <= 0 {
+		d.timeout = 30 * time.Second
+	}
+	if d.fallbackDelay == 0 {
+		d.fallbackDelay = 300 * time.Millisecond
+	}
+	if opts.LocalAddr != "" {
+		ip := net.ParseIP(opts.LocalAddr)
+		if ip == nil {
+			return nil, errors.Errorf("invalid local address \"%s\"", opts.LocalAddr)
+		}
+		// the source IP version decide the target IP version
+		switch {
+		case ip.To4() != nil && d.mode != IPv6Only:
+			d.mode = IPv4Only
+		case ip.To4() == nil && d.mode != IPv4Only:
+			d.mode = IPv6Only
+		default:
+			return nil, errors.New("local address is conflict with ip mode")
+		}
+		d.netDialer.LocalAddr = &net.TCPAddr{IP: ip}
+	}
+	if opts.Interface != "" {
+		control, err := bindToDevice(opts.Interface)
+		if err != nil {
+			return nil, err
+		}
+		d.netDialer.Control = control
+	}
+	for _, r := range opts.Routes {
+		rt, err := newRoute(r, d.netDialer)
+		if err != nil {
+			return nil, err
+		}
+		d.routes = append(d.routes, rt)
+	}
+	return &d, nil
+}
+
+// Dial is used to connect the target with the IP version preference,
+// the target and the resolved IP addresses will be checked by the acl.
+func (d *dialer) Dial(address string, a *acl) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), d.timeout)
+	defer cancel()
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	portNum, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, err
+	}
+	// don't resolve the denied FQDN
+	if a.denied(host, nil, uint16(portNum)) {
+		return nil, ErrNotAllowed
+	}
+	for _, r := range d.routes {
+		if !r.match(host, uint16(portNum)) {
+			continue
+		}
+		if r.proxy == nil {
+			break
+		}
+		if !a.allowed(host, nil, uint16(portNum)) {
+			return nil, ErrNotAllowed
+		}
+		// the upstream proxy resolve the FQDN target, but the rules about
+		// IP address need the resolved IP address, so the proxy connects
+		// the checked IP address instead of the FQDN
+		if net.ParseIP(host) == nil && a.hasIPRules() {
+			resolved, err := d.resolver.LookupIP(ctx, host)
+			if err != nil {
+				return nil, err
+			}
+			for i := 0; i < len(resolved); i++ {
+				if !a.allowed(host, resolved[i], uint16(portNum)) {
+					return nil, ErrNotAllowed
+				}
+			}
+			if len(resolved) == 0 {
+				return nil, ErrNotAllowed
+			}
+			host = resolved[0].String()
+		}
+		return r.proxy.Dial(ctx, host, uint16(portNum))
+	}
+	resolved, err := d.resolver.LookupIP(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	ips := make([]net.IP, 0, len(resolved))
+	for i := 0; i < len(resolved); i++ {
+		if a.allowed(host, resolved[i], uint16(portNum)) {
+			ips = append(ips, resolved[i])
+		}
+	}
+	if len(ips) == 0 {
+		return nil, ErrNotAllowed
+	}
+	primaries, fallbacks := d.sortIPs(ips)
+	if len(primaries) == 0 {
+		return nil, errors.Errorf("no suitable address for %s", address)
+	}
+	return d.dialParallel(ctx, primaries, fallbacks, port)
+}
+
+// dialResponse is used to get the response about the dial error.
+func dialResponse(err error) uint8 {
+	var resp Response
+	if errors.As(err, &resp) {
+		// the response from the upstream proxy
+		switch uint8(resp) {
+		case authOK, respOK, respInvalidPWD:
+			return respConnectFailed
+		default:
+			return uint8(resp)
+		}
+	}
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return respDNSFailure
+	}
+	switch {
+	case errors.Is(err, syscall.ENETUNREACH):
+		return respNetUnreachable
+	case errors.Is(err, syscall.EHOSTUNREACH):
+		return respHostUnreachable
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return respConnRefused
+	case errors.Is(err, context.DeadlineExceeded):
+		return respTimeout
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return respTimeout
+	}
+	return respConnectFailed
+}
+
+// sortIPs is used to split IP addresses to primaries and fallbacks
+// by the IP mode, the other IP version will be removed if need.
+func (d *dialer) sortIPs(ips []net.IP) (primaries, fallbacks []net.IP) {
+	var ipv4, ipv6 []net.IP
+	for i := 0; i < len(ips); i++ {
+		if ips[i].To4() != nil {
+			ipv4 = append(ipv4, ips[i])
+		} else {
+			ipv6 = append(ipv6, ips[i])
+		}
+	}
+	switch d.mode {
+	case IPv4Only:
+		return ipv4, nil
+	case IPv6Only:
+		return ipv6, nil
+	case PreferIPv4:
+		if len(ipv4) == 0 {
+			return ipv6, nil
+		}
+		return ipv4, ipv6
+	case PreferIPv6:
+		if len(ipv6) == 0 {
+			return ipv4, nil
+		}
+		return ipv6, ipv4
+	default:
+		if len(ips) == 0 {
+			return nil, nil
+		}
+		if ips[0].To4() != nil {
+			return ipv4, ipv6
+		}
+		return ipv6, ipv4
+	}
+}
+
+// dialParallel races primaries and fallbacks like Happy Eyeballs(RFC 6555),
+// the fallbacks will start after the fallback delay.
+func (d *dialer) dialParallel(
+	ctx context.Context,
+	primaries, fallbacks []net.IP,
+	port string,
+) (net.Conn, error) {
+	if len(fallbacks) == 0 {
+		return d.dialSerial(ctx, primaries, port)
+	}
+	if d.fallbackDelay < 0 {
+		return d.dialSerial(ctx, append(primaries, fallbacks...), port)
+	}
+	returned := make(chan struct{})
+	defer close(returned)
+	type dialResult struct {
+		conn    net.Conn
+		err     error
+		primary bool
+	}
+	results := make(chan dialResult) // unbuffered
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	race := func(ips []net.IP, primary bool) {
+		conn, err := d.dialSerial(ctx, ips, port)
+		select {
+		case results <- dialResult{conn: conn, err: err, primary: primary}:
+		case <-returned:
+			if conn != nil {
+				_ = conn.Close()
+			}
+		}
+	}
+	go race(primaries, true)
+	timer := time.NewTimer(d.fallbackDelay)
+	defer timer.Stop()
+	var (
+		firstErr        error
+		fallbackStarted bool
+		primaryDone     bool
+		fallbackDone    bool
+	)
+	for {
+		select {
+		case <-timer.C:
+			if !fallbackStarted {
+				fallbackStarted = true
+				go race(fallbacks, false)
+			}
+		case res := <-results:
+			if res.err == nil {
+				return res.conn, nil
+			}
+			if firstErr == nil {
+				firstErr = res.err
+			}
+			if res.primary {
+				primaryDone = true
+			} else {
+				fallbackDone = true
+			}
+			if primaryDone && fallbackDone {
+				return nil, firstErr
+			}
+			// start fallbacks immediately if primaries failed
+			if res.primary && !fallbackStarted {
+				fallbackStarted = true
+				timer.Stop()
+				go race(fallbacks, false)
+			}
+		}
+	}
+}
+
+func (d *dialer) dialSerial(ctx context.Context, ips []net.IP, port string) (net.Conn, error) {
+	var firstErr error
+	for i := 0; i < len(ips); i++ {
+		conn, err := d.netDialer.DialContext(ctx, "tcp", net.JoinHostPort(ips[i].String(), port))
+		if err == nil {
+			return conn, nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, firstErr
+}
@@ -0,0 +1,18 @@
+package socks
+
+import (
+	"syscall"
+)
+
+func bindToDevice(device string) (func(string, string, syscall.RawConn) error, error) {
+	return func(_, _ string, c syscall.RawConn) error {
+		var err error
+		cErr := c.Control(func(fd uintptr) {
+			err = syscall.BindToDevice(int(fd), device)
+		})
+		if cErr != nil {
+			return cErr
+		}
+		return err
+	}, nil
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package socks
+
+import (
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+func bindToDevice(string) (func(string, string, syscall.RawConn) error, error) {
+	return nil, errors.New("bind to interface is only supported on Linux")
+}
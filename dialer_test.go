@@ -0,0 +1,106 @@
+package socks
+
+import (
+	"context"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDialer_sortIPs(t *testing.T) {
+	ipv4 := net.ParseIP("1.1.1.1")
+	ipv6 := net.ParseIP("::1")
+	ips := []net.IP{ipv6, ipv4}
+	testData := map[IPMode][2][]net.IP{
+		IPDefault:  {{ipv6}, {ipv4}},
+		IPv4Only:   {{ipv4}, nil},
+		IPv6Only:   {{ipv6}, nil},
+		PreferIPv4: {{ipv4}, {ipv6}},
+		PreferIPv6: {{ipv6}, {ipv4}},
+	}
+	for mode, expected := range testData {
+		d := dialer{mode: mode}
+		primaries, fallbacks := d.sortIPs(ips)
+		require.Equal(t, expected[0], primaries, mode)
+		require.Equal(t, expected[1], fallbacks, mode)
+	}
+}
+
+func TestDialer_Dial(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer func() { _ = listener.Close() }()
+	go func() {
+		conn, err := listener.Accept()
+		if err == nil {
+			_ = conn.Close()
+		}
+	}()
+	d, err := newDialer(&DialOptions{LocalAddr: "127.0.0.1", FallbackDelay: -1})
+	require.NoError(t, err)
+	conn, err := d.Dial(listener.Addr().String(), nil)
+	require.NoError(t, err)
+	_ = conn.Close()
+
+	// local address is conflict with target
+	d, err = newDialer(&DialOptions{LocalAddr: "::1"})
+	require.NoError(t, err)
+	_, err = d.Dial(listener.Addr().String(), nil)
+	require.Error(t, err)
+
+	_, err = newDialer(&DialOptions{LocalAddr: "::1", IPMode: IPv4Only})
+	require.Error(t, err)
+
+	// denied by acl
+	a, err := (&ACL{Deny: []string{"127.0.0.0/8"}}).compile()
+	require.NoError(t, err)
+	d, err = newDialer(nil)
+	require.NoError(t, err)
+	_, err = d.Dial(listener.Addr().String(), a)
+	require.Equal(t, ErrNotAllowed, err)
+}
+
+func TestDialResponse(t *testing.T) {
+	opErr := func(errno syscall.Errno) error {
+		return &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", errno)}
+	}
+	testData := []struct {
+		err  error
+		resp uint8
+	}{
+		{ErrNotAllowed, respNotAllowed},
+		{errors.WithMessage(ErrConnRefused, "quic-socks upstream proxy"), respConnRefused},
+		{errors.WithMessage(ErrInvalidPassword, "quic-socks upstream proxy"), respConnectFailed},
+		{&net.DNSError{Err: "no such host", Name: "test", IsNotFound: true}, respDNSFailure},
+		{opErr(syscall.ENETUNREACH), respNetUnreachable},
+		{opErr(syscall.EHOSTUNREACH), respHostUnreachable},
+		{opErr(syscall.ECONNREFUSED), respConnRefused},
+		{errors.WithStack(context.DeadlineExceeded), respTimeout},
+		{&net.OpError{Op: "dial", Net: "tcp", Err: testTimeoutError{}}, respTimeout},
+		{errors.New("unknown"), respConnectFailed},
+	}
+	for _, td := range testData {
+		require.Equal(t, td.resp, dialResponse(td.err), td.err.Error())
+	}
+
+	// connect to a closed port
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	address := listener.Addr().String()
+	require.NoError(t, listener.Close())
+	d, err := newDialer(nil)
+	require.NoError(t, err)
+	_, err = d.Dial(address, nil)
+	require.Error(t, err)
+	require.Equal(t, respConnRefused, dialResponse(err))
+}
+
+type testTimeoutError struct{}
+
+func (testTimeoutError) Error() string   { return "i/o timeout" }
+func (testTimeoutError) Timeout() bool   { return true }
+func (testTimeoutError) Temporary() bool { return true }
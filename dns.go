@@ -0,0 +1,252 @@
+package socks
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// remote DNS
+//
+// after authentication, client send typeDNS instead of the host data,
+// server reply respOK, then client and server exchange DNS messages
+// with a 2 bytes length prefix(like DNS over TCP) until one of them
+// close the connection, server resolve them with the upstream DNS
+// servers of the server side Resolver. If the user has an ACL, the
+// names in the query must be allowed by it, or the server reply REFUSED.
+//
+// +-------+--------+---------+
+// | type  | length | message |
+// +-------+--------+---------+
+// | uint8 | uint16 |   var   |
+// +-------+--------+---------+
+
+const (
+	dnsHeaderSize = 12
+	dnsLenSize    = 2
+)
+
+// WriteDNSMessage is used to write the DNS message with a 2 bytes
+// length prefix, like DNS over TCP and the remote DNS mode.
+func WriteDNSMessage(w io.Writer, msg []byte) error {
+	if len(msg) > 65535 {
+		return errors.New("DNS message too large")
+	}
+	buf := make([]byte, dnsLenSize+len(msg))
+	binary.BigEndian.PutUint16(buf, uint16(len(msg)))
+	copy(buf[dnsLenSize:], msg)
+	_, err := w.Write(buf)
+	return err
+}
+
+// ReadDNSMessage is used to read the DNS message with a 2 bytes
+// length prefix, like DNS over TCP and the remote DNS mode.
+func ReadDNSMessage(r io.Reader) ([]byte, error) {
+	l := make([]byte, dnsLenSize)
+	_, err := io.ReadFull(r, l)
+	if err != nil {
+		return nil, err
+	}
+	msg := make([]byte, int(binary.BigEndian.Uint16(l)))
+	_, err = io.ReadFull(r, msg)
+	if err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// serverFailure is used to make a SERVFAIL response from the query.
+func serverFailure(query []byte) []byte {
+	return errorResponse(query, 2)
+}
+
+// refused is used to make a REFUSED response from the query.
+func refused(query []byte) []byte {
+	return errorResponse(query, 5)
+}
+
+func errorResponse(query []byte, rcode byte) []byte {
+	resp := make([]byte, len(query))
+	copy(resp, query)
+	resp[2] |= 0x80                       // QR
+	resp[3] = resp[3]&0x70 | 0x80 | rcode // RA and RCODE
+	return resp
+}
+
+var errInvalidQuestion = errors.New("invalid DNS question")
+
+// questionNames is used to get the names in the question section,
+// the compression is not allowed in the query.
+func questionNames(query []byte) ([]string, error) {
+	count := int(binary.BigEndian.Uint16(query[4:6]))
+	names := make([]string, 0, count)
+	offset := dnsHeaderSize
+	for i := 0; i < count; i++ {
+		var name []byte
+		for {
+			if offset >= len(query) {
+				return nil, errInvalidQuestion
+			}
+			l := int(query[offset])
+			offset++
+			if l == 0 {
+				break
+			}
+			if l > 63 || offset+l > len(query) {
+				return nil, errInvalidQuestion
+			}
+			if len(name) != 0 {
+				name = append(name, '.')
+			}
+			name = append(name, query[offset:offset+l]...)
+			offset += l
+		}
+		// QTYPE and QCLASS
+		offset += 4
+		if offset > len(query) {
+			return nil, errInvalidQuestion
+		}
+		names = append(names, string(name))
+	}
+	return names, nil
+}
+
+// responseTTL is used to get the cache time about the response, it is the
+// minimum TTL of the answers, if there is no answer, it is the negative
+// TTL about the SOA record in the authority section(RFC 2308), ok is
+// false if the response has no TTL.
+func responseTTL(resp []byte) (ttl time.Duration, ok bool) {
+	if len(resp) < dnsHeaderSize {
+		return 0, false
+	}
+	qdCount := int(binary.BigEndian.Uint16(resp[4:6]))
+	anCount := int(binary.BigEndian.Uint16(resp[6:8]))
+	nsCount := int(binary.BigEndian.Uint16(resp[8:10]))
+	offset := dnsHeaderSize
+	for i := 0; i < qdCount; i++ {
+		offset = skipName(resp, offset)
+		// QTYPE and QCLASS
+		if offset < 0 || offset+4 > len(resp) {
+			return 0, false
+		}
+		offset += 4
+	}
+	min := func(d time.Duration) {
+		if !ok || d < ttl {
+			ttl = d
+			ok = true
+		}
+	}
+	for i := 0; i < anCount+nsCount; i++ {
+		offset = skipName(resp, offset)
+		// TYPE, CLASS, TTL and RDLENGTH
+		if offset < 0 || offset+10 > len(resp) {
+			return 0, false
+		}
+		typ := binary.BigEndian.Uint16(resp[offset:])
+		recordTTL := time.Duration(binary.BigEndian.Uint32(resp[offset+4:])) * time.Second
+		rdata := offset + 10
+		offset = rdata + int(binary.BigEndian.Uint16(resp[offset+8:]))
+		if offset > len(resp) {
+			return 0, false
+		}
+		switch {
+		case i < anCount:
+			min(recordTTL)
+		case anCount == 0 && typ == 6 && offset-rdata >= 4: // SOA
+			min(recordTTL)
+			// the last field of the SOA is MINIMUM
+			min(time.Duration(binary.BigEndian.Uint32(resp[offset-4:])) * time.Second)
+		}
+	}
+	return ttl, ok
+}
+
+// skipName is used to skip the name at offset, it
+// returns -1 if the name is invalid.
+func skipName(msg []byte, offset int) int {
+	for {
+		if offset < 0 || offset >= len(msg) {
+			return -1
+		}
+		l := int(msg[offset])
+		switch {
+		case l == 0:
+			return offset + 1
+		case l&0xC0 == 0xC0: // compression pointer
+			return offset + 2
+		case l > 63:
+			return -1
+		}
+		offset += 1 + l
+	}
+}
+
+// ConnectDNS is used to switch the connection to remote DNS mode,
+// after it, use ExchangeDNS to resolve DNS message with the server.
+func ConnectDNS(conn net.Conn) (net.Conn, error) {
+	_, err := conn.Write([]byte{typeDNS})
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	resp := make([]byte, respSize)
+	_, err = io.ReadFull(conn, resp)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	if resp[0] != respOK {
+		_ = conn.Close()
+		return nil, Response(resp[0])
+	}
+	_ = conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+// ExchangeDNS is used to send a DNS query message and receive the
+// response message, conn must be returned by ConnectDNS.
+func ExchangeDNS(conn net.Conn, msg []byte) ([]byte, error) {
+	if len(msg) < dnsHeaderSize {
+		return nil, errors.New("DNS message too short")
+	}
+	err := WriteDNSMessage(conn, msg)
+	if err != nil {
+		return nil, err
+	}
+	return ReadDNSMessage(conn)
+}
+
+// serveDNS is called after the respOK is sent.
+func (s *Server) serveDNS(conn net.Conn, u *user, sess *session) {
+	sess.setTarget("dns")
+	for {
+		query, err := ReadDNSMessage(conn)
+		if err != nil {
+			return
+		}
+		if len(query) < dnsHeaderSize {
+			return
+		}
+		atomic.AddUint64(&sess.upload, uint64(len(query)))
+		var resp []byte
+		if u.allowResolve(query) {
+			resp, err = s.dialer.resolver.Exchange(context.Background(), query)
+			if err != nil {
+				resp = serverFailure(query)
+			}
+		} else {
+			resp = refused(query)
+		}
+		err = WriteDNSMessage(conn, resp)
+		if err != nil {
+			return
+		}
+		atomic.AddUint64(&sess.download, uint64(len(resp)))
+	}
+}
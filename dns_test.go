@@ -0,0 +1,80 @@
+package socks
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDNSMessage(t *testing.T) {
+	msg := []byte{0x12, 0x34, 0x01, 0x00, 0, 1, 0, 0, 0, 0, 0, 0}
+	buf := bytes.Buffer{}
+	require.NoError(t, WriteDNSMessage(&buf, msg))
+	require.Equal(t, 2+len(msg), buf.Len())
+	b, err := ReadDNSMessage(&buf)
+	require.NoError(t, err)
+	require.Equal(t, msg, b)
+
+	resp := serverFailure(msg)
+	require.Equal(t, []byte{0x12, 0x34, 0x81, 0x82}, resp[:4])
+	require.Equal(t, msg[4:], resp[4:])
+	resp = refused(msg)
+	require.Equal(t, []byte{0x12, 0x34, 0x81, 0x85}, resp[:4])
+}
+
+func TestQuestionNames(t *testing.T) {
+	// "www.example.com" A IN
+	query := []byte{0x12, 0x34, 0x01, 0x00, 0, 1, 0, 0, 0, 0, 0, 0,
+		3, 'w', 'w', 'w', 7, 'e', 'x', 'a', 'm', 'p', 'l', 'e', 3, 'c', 'o', 'm', 0,
+		0, 1, 0, 1}
+	names, err := questionNames(query)
+	require.NoError(t, err)
+	require.Equal(t, []string{"www.example.com"}, names)
+
+	// truncated and compressed
+	_, err = questionNames(query[:len(query)-1])
+	require.Error(t, err)
+	_, err = questionNames(append(query[:dnsHeaderSize:dnsHeaderSize], 0xC0, 0x0C, 0, 1, 0, 1))
+	require.Error(t, err)
+
+	// user with ACL
+	u := user{}
+	u.acl, err = (&ACL{Allow: []string{"*.example.com"}}).compile()
+	require.NoError(t, err)
+	require.True(t, u.allowResolve(query))
+	copy(query[dnsHeaderSize+5:], "abcdefg")
+	require.False(t, u.allowResolve(query))
+	require.True(t, (&user{}).allowResolve(query))
+}
+
+func TestResolver_Exchange(t *testing.T) {
+	// a DNS server that reply the query with QR flag
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer func() { _ = conn.Close() }()
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			buf[2] |= 0x80
+			_, _ = conn.WriteTo(buf[:n], addr)
+		}
+	}()
+	for _, server := range []string{
+		conn.LocalAddr().String(),
+		"udp://" + conn.LocalAddr().String(),
+	} {
+		r, err := NewResolver(&ResolverOptions{Servers: []string{server}})
+		require.NoError(t, err)
+		query := []byte{0xAB, 0xCD, 0x01, 0x00, 0, 1, 0, 0, 0, 0, 0, 0}
+		resp, err := r.Exchange(context.Background(), query)
+		require.NoError(t, err)
+		require.Equal(t, []byte{0xAB, 0xCD, 0x81, 0x00}, resp[:4])
+	}
+}
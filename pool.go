@@ -0,0 +1,274 @@
+package socks
+
+import (
+	"math"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// PoolOptions contains options about Pool.
+type PoolOptions struct {
+	// MinSize is the minimum number of the idle connections, default is 1
+	MinSize int
+
+	// MaxSize is the maximum number of the idle connections, default is 128
+	MaxSize int
+
+	// MaxAge is the maximum age of an idle connection, default is 45s,
+	// it must less than the deadline set by Client.Dial(1 minute)
+	MaxAge time.Duration
+
+	// Workers is the maximum number of the concurrent dials
+	// about refill the pool, default is MaxSize/10+1
+	Workers int
+
+	// OnDialError is called when failed to dial a connection for refill
+	OnDialError func(err error)
+}
+
+type pooledConn struct {
+	net.Conn
+	created time.Time
+}
+
+// Pool is a pre-connection pool, it keeps authenticated connections for
+// reduce the latency of the connect request. The size of the pool will
+// be adjusted by the observed request rate, connections that are too old
+// or closed by the server will be evicted.
+type Pool struct {
+	gets uint64 // atomic, the number of Get in current second
+
+	dialer      Dialer
+	minSize     int
+	maxSize     int
+	maxAge      time.Duration
+	workers     int
+	onDialError func(err error)
+
+	idle    []*pooledConn // the oldest is the first
+	dialing int
+	target  int
+	rate    float64       // EWMA about Get per second
+	latency time.Duration // EWMA about dial latency
+	mu      sync.Mutex
+
+	stopSignal chan struct{}
+	wg         sync.WaitGroup
+}
+
+// poolAdjustInterval is the interval about adjust the pool.
+var poolAdjustInterval = time.Second
+
+// NewPool is used to create a pre-connection pool, opts can be nil.
+func NewPool(dialer Dialer, opts *PoolOptions) *Pool {
+	if opts == nil {
+		opts = new(PoolOptions)
+	}
+	p := Pool{
+		dialer:      dialer,
+		minSize:     opts.MinSize,
+		maxSize:     opts.MaxSize,
+		maxAge:      opts.MaxAge,
+		workers:     opts.Workers,
+		onDialError: opts.OnDialError,
+		stopSignal:  make(chan struct{}),
+	}
+	if p.minSize <= 0 {
+		p.minSize = 1
+	}
+	if p.maxSize <= 0 {
+		p.maxSize = 128
+	}
+	if p.maxSize < p.minSize {
+		p.maxSize = p.minSize
+	}
+	if p.maxAge <= 0 {
+		p.maxAge = 45 * time.Second
+	}
+	if p.workers <= 0 {
+		p.workers = p.maxSize/10 + 1
+	}
+	p.target = p.minSize
+	p.wg.Add(1)
+	go p.maintain()
+	return &p
+}
+
+// Get is used to get an idle connection from the pool,
+// if the pool is empty, it will dial a new connection.
+func (p *Pool) Get() (net.Conn, error) {
+	conn := p.TryGet()
+	if conn != nil {
+		return conn, nil
+	}
+	return p.dial()
+}
+
+// TryGet is used to get an idle connection from the pool,
+// if the pool is empty, it will return nil.
+func (p *Pool) TryGet() net.Conn {
+	atomic.AddUint64(&p.gets, 1)
+	for {
+		p.mu.Lock()
+		if len(p.idle) == 0 {
+			p.mu.Unlock()
+			return nil
+		}
+		conn := p.idle[0]
+		p.idle[0] = nil
+		p.idle = p.idle[1:]
+		p.mu.Unlock()
+		if p.usable(conn) {
+			return conn.Conn
+		}
+		_ = conn.Close()
+	}
+}
+
+// Len is used to get the number of the idle connections.
+func (p *Pool) Len() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.idle)
+}
+
+// usable is used to check the connection is not expired and not closed.
+func (p *Pool) usable(conn *pooledConn) bool {
+	if time.Since(conn.created) > p.maxAge {
+		return false
+	}
+	if c, ok := conn.Conn.(*Conn); ok {
+		return c.isAlive()
+	}
+	return true
+}
+
+func (p *Pool) dial() (net.Conn, error) {
+	start := time.Now()
+	conn, err := p.dialer.Dial()
+	if err != nil {
+		return nil, err
+	}
+	latency := time.Since(start)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.latency == 0 {
+		p.latency = latency
+	} else {
+		p.latency = (p.latency*7 + latency) / 8
+	}
+	return conn, nil
+}
+
+func (p *Pool) maintain() {
+	defer p.wg.Done()
+	ticker := time.NewTicker(poolAdjustInterval)
+	defer ticker.Stop()
+	p.adjust()
+	for {
+		select {
+		case <-ticker.C:
+			p.adjust()
+		case <-p.stopSignal:
+			return
+		}
+	}
+}
+
+// adjust is used to evict unusable connections, calculate the
+// target size by the request rate and refill or shrink the pool.
+func (p *Pool) adjust() {
+	gets := float64(atomic.SwapUint64(&p.gets, 0))
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	// evict
+	idle := p.idle[:0]
+	for _, conn := range p.idle {
+		if p.usable(conn) {
+			idle = append(idle, conn)
+		} else {
+			_ = conn.Close()
+		}
+	}
+	for i := len(idle); i < len(p.idle); i++ {
+		p.idle[i] = nil
+	}
+	p.idle = idle
+	// the pool need hold the connections that will be
+	// requested during the time about refill the pool
+	p.rate = p.rate*0.8 + gets*0.2
+	window := (p.latency + time.Second).Seconds()
+	target := p.minSize + int(math.Ceil(p.rate*window))
+	if target > p.maxSize {
+		target = p.maxSize
+	}
+	p.target = target
+	// shrink, close the oldest connections
+	if n := len(p.idle) - p.target; n > 0 {
+		for i := 0; i < n; i++ {
+			_ = p.idle[i].Close()
+			p.idle[i] = nil
+		}
+		p.idle = p.idle[n:]
+	}
+	// refill
+	for len(p.idle)+p.dialing < p.target && p.dialing < p.workers {
+		p.dialing++
+		p.wg.Add(1)
+		go p.refill()
+	}
+}
+
+func (p *Pool) refill() {
+	defer p.wg.Done()
+	for {
+		select {
+		case <-p.stopSignal:
+			p.mu.Lock()
+			p.dialing--
+			p.mu.Unlock()
+			return
+		default:
+		}
+		conn, err := p.dial()
+		p.mu.Lock()
+		if err != nil {
+			p.dialing--
+			p.mu.Unlock()
+			if p.onDialError != nil {
+				p.onDialError(err)
+			}
+			// retry at the next adjust
+			return
+		}
+		select {
+		case <-p.stopSignal:
+			p.dialing--
+			p.mu.Unlock()
+			_ = conn.Close()
+			return
+		default:
+		}
+		p.idle = append(p.idle, &pooledConn{Conn: conn, created: time.Now()})
+		if len(p.idle)+p.dialing > p.target {
+			p.dialing--
+			p.mu.Unlock()
+			return
+		}
+		p.mu.Unlock()
+	}
+}
+
+// Close is used to stop refill and close all idle connections.
+func (p *Pool) Close() {
+	close(p.stopSignal)
+	p.wg.Wait()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, conn := range p.idle {
+		_ = conn.Close()
+	}
+	p.idle = nil
+}
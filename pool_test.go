@@ -0,0 +1,86 @@
+package socks
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+type testDialer struct {
+	dials uint64
+	fail  bool
+}
+
+func (d *testDialer) Dial() (net.Conn, error) {
+	if d.fail {
+		return nil, errors.New("test dial error")
+	}
+	atomic.AddUint64(&d.dials, 1)
+	conn, _ := net.Pipe()
+	return conn, nil
+}
+
+func TestPool(t *testing.T) {
+	// the pool is not refilled after Get
+	interval := poolAdjustInterval
+	poolAdjustInterval = time.Hour
+	defer func() { poolAdjustInterval = interval }()
+
+	dialer := new(testDialer)
+	pool := NewPool(dialer, &PoolOptions{MinSize: 2, MaxSize: 4})
+	defer pool.Close()
+	require.Eventually(t, func() bool { return pool.Len() == 2 }, 3*time.Second, 10*time.Millisecond)
+	conn, err := pool.Get()
+	require.NoError(t, err)
+	_ = conn.Close()
+	require.Equal(t, 1, pool.Len())
+	require.Equal(t, uint64(2), atomic.LoadUint64(&dialer.dials))
+}
+
+func TestPool_Evict(t *testing.T) {
+	dialer := new(testDialer)
+	pool := NewPool(dialer, &PoolOptions{MinSize: 1, MaxAge: 50 * time.Millisecond})
+	defer pool.Close()
+	require.Eventually(t, func() bool { return pool.Len() == 1 }, 3*time.Second, 10*time.Millisecond)
+	time.Sleep(100 * time.Millisecond)
+	// the idle connection is expired, so dial a new one
+	conn, err := pool.Get()
+	require.NoError(t, err)
+	_ = conn.Close()
+	require.Equal(t, uint64(2), atomic.LoadUint64(&dialer.dials))
+}
+
+func TestPool_Adjust(t *testing.T) {
+	dialer := new(testDialer)
+	pool := NewPool(dialer, &PoolOptions{MinSize: 1, MaxSize: 8})
+	defer pool.Close()
+	for i := 0; i < 100; i++ {
+		conn, err := pool.Get()
+		require.NoError(t, err)
+		_ = conn.Close()
+	}
+	pool.adjust()
+	pool.mu.Lock()
+	target := pool.target
+	pool.mu.Unlock()
+	require.Equal(t, 8, target)
+}
+
+func TestPool_DialError(t *testing.T) {
+	dialer := &testDialer{fail: true}
+	errCh := make(chan error, 1)
+	pool := NewPool(dialer, &PoolOptions{OnDialError: func(err error) {
+		select {
+		case errCh <- err:
+		default:
+		}
+	}})
+	defer pool.Close()
+	require.Error(t, <-errCh)
+	_, err := pool.Get()
+	require.Error(t, err)
+}
@@ -4,7 +4,7 @@ import (
 	"encoding/binary"
 	"io"
 	"net"
-	"strconv"
+	"strings"
 
 	"github.com/pkg/errors"
 )
@@ -12,7 +12,8 @@ import (
 const nextProto = "h3-27"
 
 // client connect
-// type can be 0x00(IPv4), 0x01(IPv6), 0x02(FQDN)
+// type can be 0x01(IPv4), 0x02(IPv6), 0x03(FQDN), 0x04(DNS, see dns.go)
+// or 0x05(reverse tunnel, see reverse.go)
 //
 // host size = 4             (type = IPv4)
 // host size = 16            (type = IPv6)
@@ -22,8 +23,18 @@ const nextProto = "h3-27"
 // +-----+-------+------+--------+
 // | var | uint8 | var  | uint16 |
 // +-----+-------+------+--------+
+//
+// if the flag typeBound is set in type, the server replies the bound
+// address about the target connection after respOK, the format is
+// the same as type + host + port, the port can be zero.
+//
+// pwd is sha256(sha256(password) + padding) + padding, the padding is
+// 128-255 random bytes, the first byte of the padding is the padding
+// size minus 128, so the server only checks the hash once for each user.
 
 const (
+	minPaddingSize = 128
+
 	typeSize = 1
 	fqdnSize = 1
 	portSize = 2
@@ -34,6 +45,10 @@ const (
 	typeIPv4 uint8 = iota + 1
 	typeIPv6
 	typeFQDN
+	typeDNS
+	typeReverse
+
+	typeBound uint8 = 0x80 // flag, see above
 )
 
 const (
@@ -42,100 +57,259 @@ const (
 	respInvalidPWD
 	respInvalidHost
 	respConnectFailed
+	respNetUnreachable
+	respHostUnreachable
+	respConnRefused
+	respTimeout
+	respDNSFailure
+	respNotAllowed
+	respQuotaExceeded
+	respListenFailed
+)
+
+// errors about pack and unpack host data.
+var (
+	ErrInvalidType = errors.New("invalid host type")
+	ErrInvalidFQDN = errors.New("invalid FQDN")
+	ErrInvalidPort = errors.New("invalid port")
 )
 
 // type + host + port
-func packHostData(host string, port uint16) ([]byte, error) {
+func packHostData(addr *Addr) ([]byte, error) {
+	if addr.Port == 0 {
+		return nil, ErrInvalidPort
+	}
+	return packAddr(addr)
+}
+
+// packAddr is like packHostData, but the port can be zero,
+// it is used to pack the bound address.
+func packAddr(addr *Addr) ([]byte, error) {
 	var hostData []byte
-	ip := net.ParseIP(host)
-	if ip != nil {
-		ip4 := ip.To4()
-		if ip4 != nil { // IPv4
-			hostData = make([]byte, typeSize+net.IPv4len)
-			hostData[0] = typeIPv4
-			copy(hostData[typeSize:], ip4)
-		} else { // IPv6
-			ip6 := ip.To16()
-			if ip6 != nil {
-				hostData = make([]byte, typeSize+net.IPv6len)
-				hostData[0] = typeIPv6
-				copy(hostData[typeSize:], ip6)
-			} else {
-				return nil, errors.New("unknown host type")
-			}
+	switch addr.Type() {
+	case AddrIPv4:
+		hostData = make([]byte, typeSize+net.IPv4len)
+		hostData[0] = typeIPv4
+		copy(hostData[typeSize:], addr.IP.To4())
+	case AddrIPv6:
+		ip6 := addr.IP.To16()
+		if ip6 == nil {
+			return nil, ErrInvalidType
 		}
-	} else { // FQDN
-		if len(host) > 255 {
-			return nil, errors.New("FQDN too long")
+		hostData = make([]byte, typeSize+net.IPv6len)
+		hostData[0] = typeIPv6
+		copy(hostData[typeSize:], ip6)
+	default:
+		err := checkFQDN(addr.FQDN)
+		if err != nil {
+			return nil, err
 		}
-		h := []byte(host)
-		l := len(h)
+		l := len(addr.FQDN)
 		hostData = make([]byte, typeSize+fqdnSize+l)
 		hostData[0] = typeFQDN
 		hostData[1] = byte(l)
-		copy(hostData[typeSize+fqdnSize:], h)
+		copy(hostData[typeSize+fqdnSize:], addr.FQDN)
 	}
 	// set port
 	portData := make([]byte, portSize)
-	binary.BigEndian.PutUint16(portData, port)
+	binary.BigEndian.PutUint16(portData, addr.Port)
 	return append(hostData, portData...), nil
 }
 
-func unpackHostData(u io.Reader) (string, error) {
+// unpackHostData is used to read the host data, it returns the
+// errors from the reader or the errors about invalid host data.
+func unpackHostData(u io.Reader) (*Addr, error) {
+	addr, err := unpackAddr(u)
+	if err != nil {
+		return nil, err
+	}
+	if addr.Port == 0 {
+		return nil, ErrInvalidPort
+	}
+	return addr, nil
+}
+
+// unpackAddr is like unpackHostData, but the port can be zero,
+// it is used to unpack the bound address.
+func unpackAddr(u io.Reader) (*Addr, error) {
 	typ := make([]byte, typeSize)
-	_, err := u.Read(typ)
+	_, err := io.ReadFull(u, typ)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
-	var host string
+	addr := Addr{}
 	switch typ[0] {
 	case typeIPv4:
 		ip := make([]byte, net.IPv4len)
 		_, err = io.ReadFull(u, ip)
 		if err != nil {
-			return "", err
+			return nil, err
 		}
-		host = net.IP(ip).String()
+		addr.IP = ip
 	case typeIPv6:
 		ip := make([]byte, net.IPv6len)
 		_, err = io.ReadFull(u, ip)
 		if err != nil {
-			return "", err
+			return nil, err
 		}
-		host = net.IP(ip).String()
+		addr.IP = ip
 	case typeFQDN:
 		fqdnLen := make([]byte, fqdnSize)
-		_, err = u.Read(fqdnLen)
+		_, err = io.ReadFull(u, fqdnLen)
 		if err != nil {
-			return "", err
+			return nil, err
+		}
+		if fqdnLen[0] == 0 {
+			return nil, ErrInvalidFQDN
 		}
 		fqdn := make([]byte, int(fqdnLen[0]))
 		_, err = io.ReadFull(u, fqdn)
 		if err != nil {
-			return "", err
+			return nil, err
+		}
+		addr.FQDN = string(fqdn)
+		err = checkFQDN(addr.FQDN)
+		if err != nil {
+			return nil, err
 		}
-		host = string(fqdn)
 	default:
-		return "", errors.New("invalid type")
+		return nil, ErrInvalidType
 	}
 	port := make([]byte, portSize)
 	_, err = io.ReadFull(u, port)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
-	portStr := strconv.Itoa(int(binary.BigEndian.Uint16(port)))
-	return net.JoinHostPort(host, portStr), nil
+	addr.Port = binary.BigEndian.Uint16(port)
+	return &addr, nil
 }
 
+// checkFQDN is used to check the length and the characters about FQDN,
+// labels are split by ".", a label contains letters, digits, "-" and "_",
+// it can't start or end with "-", the trailing "." is allowed.
+func checkFQDN(fqdn string) error {
+	if len(fqdn) == 0 || len(fqdn) > 255 {
+		return ErrInvalidFQDN
+	}
+	if fqdn[len(fqdn)-1] == '.' {
+		fqdn = fqdn[:len(fqdn)-1]
+	}
+	for _, label := range strings.Split(fqdn, ".") {
+		if len(label) == 0 || len(label) > 63 {
+			return ErrInvalidFQDN
+		}
+		if label[0] == '-' || label[len(label)-1] == '-' {
+			return ErrInvalidFQDN
+		}
+		for i := 0; i < len(label); i++ {
+			c := label[i]
+			switch {
+			case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+			case c == '-', c == '_':
+			default:
+				return ErrInvalidFQDN
+			}
+		}
+	}
+	return nil
+}
+
+// Response is the error response from the server.
 type Response uint8
 
+// errors about Response, they can be used with errors.Is.
+var (
+	ErrInvalidPassword error = Response(respInvalidPWD)
+	ErrInvalidHost     error = Response(respInvalidHost)
+	ErrConnectFailed   error = Response(respConnectFailed)
+	ErrNetUnreachable  error = Response(respNetUnreachable)
+	ErrHostUnreachable error = Response(respHostUnreachable)
+	ErrConnRefused     error = Response(respConnRefused)
+	ErrTimeout         error = Response(respTimeout)
+	ErrDNSFailure      error = Response(respDNSFailure)
+	ErrNotAllowed      error = Response(respNotAllowed)
+	ErrQuotaExceeded   error = Response(respQuotaExceeded)
+	ErrListenFailed    error = Response(respListenFailed)
+)
+
 func (r Response) Error() string {
 	switch uint8(r) {
 	case respInvalidPWD:
 		return "invalid password"
+	case respInvalidHost:
+		return "invalid host"
 	case respConnectFailed:
 		return "failed to connect target"
+	case respNetUnreachable:
+		return "network unreachable"
+	case respHostUnreachable:
+		return "host unreachable"
+	case respConnRefused:
+		return "connection refused"
+	case respTimeout:
+		return "connect timeout"
+	case respDNSFailure:
+		return "failed to resolve target"
+	case respNotAllowed:
+		return "not allowed by ruleset"
+	case respQuotaExceeded:
+		return "quota exceeded"
+	case respListenFailed:
+		return "failed to listen reverse port"
 	default:
 		return "unknown error"
 	}
 }
+
+// reply codes about SOCKS5(RFC 1928).
+const (
+	socks5Succeeded        uint8 = 0x00
+	socks5GeneralFailure   uint8 = 0x01
+	socks5NotAllowed       uint8 = 0x02
+	socks5NetUnreachable   uint8 = 0x03
+	socks5HostUnreachable  uint8 = 0x04
+	socks5ConnRefused      uint8 = 0x05
+	socks5TTLExpired       uint8 = 0x06
+	socks5AddrNotSupported uint8 = 0x08
+)
+
+// SOCKS5Reply is used to get the reply code about SOCKS5(RFC 1928).
+func (r Response) SOCKS5Reply() uint8 {
+	switch uint8(r) {
+	case respNetUnreachable:
+		return socks5NetUnreachable
+	case respHostUnreachable, respDNSFailure:
+		return socks5HostUnreachable
+	case respConnRefused:
+		return socks5ConnRefused
+	case respTimeout:
+		return socks5TTLExpired
+	case respNotAllowed, respQuotaExceeded:
+		return socks5NotAllowed
+	case respInvalidHost:
+		return socks5AddrNotSupported
+	default:
+		return socks5GeneralFailure
+	}
+}
+
+// responseFromSOCKS5Reply is used to convert the reply code about
+// SOCKS5 upstream proxy to the response.
+func responseFromSOCKS5Reply(reply uint8) Response {
+	switch reply {
+	case socks5NotAllowed:
+		return Response(respNotAllowed)
+	case socks5NetUnreachable:
+		return Response(respNetUnreachable)
+	case socks5HostUnreachable:
+		return Response(respHostUnreachable)
+	case socks5ConnRefused:
+		return Response(respConnRefused)
+	case socks5TTLExpired:
+		return Response(respTimeout)
+	case socks5AddrNotSupported:
+		return Response(respInvalidHost)
+	default:
+		return Response(respConnectFailed)
+	}
+}
@@ -0,0 +1,76 @@
+//go:build go1.18
+// +build go1.18
+
+package socks
+
+import (
+	"bytes"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func FuzzUnpackHostData(f *testing.F) {
+	for _, host := range []string{"1.1.1.1", "::1", "google.com"} {
+		addr, _ := NewAddr(host, 443)
+		b, _ := packHostData(addr)
+		f.Add(b)
+	}
+	f.Add([]byte{typeFQDN, 0x00, 0x01, 0xBB})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		addr, err := unpackHostData(bytes.NewReader(data))
+		if err != nil {
+			return
+		}
+		// the valid host data must be packed again
+		b, err := packHostData(addr)
+		if err != nil {
+			t.Fatalf("failed to pack %q: %s", addr, err)
+		}
+		addr2, err := unpackHostData(bytes.NewReader(b))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if addr.String() != addr2.String() {
+			t.Fatalf("round trip: %q != %q", addr, addr2)
+		}
+		// the address string must be parsed again
+		addr3, err := ParseAddr(addr.String())
+		if err != nil {
+			t.Fatalf("failed to parse %q: %s", addr, err)
+		}
+		if addr.String() != addr3.String() {
+			t.Fatalf("round trip: %q != %q", addr, addr3)
+		}
+	})
+}
+
+func FuzzPackHostData(f *testing.F) {
+	f.Add("1.1.1.1", uint16(443))
+	f.Add("::1", uint16(443))
+	f.Add("google.com", uint16(443))
+	f.Fuzz(func(t *testing.T, host string, port uint16) {
+		addr, err := NewAddr(host, port)
+		if err != nil {
+			return
+		}
+		b, err := packHostData(addr)
+		if err != nil {
+			t.Fatalf("failed to pack %q: %s", host, err)
+		}
+		unpacked, err := unpackHostData(bytes.NewReader(b))
+		if err != nil {
+			t.Fatalf("failed to unpack %q: %s", host, err)
+		}
+		address := unpacked.String()
+		host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+		if ip := net.ParseIP(host); ip != nil {
+			host = ip.String()
+		}
+		expected := net.JoinHostPort(host, strconv.Itoa(int(port)))
+		if address != expected {
+			t.Fatalf("round trip: %q != %q", address, expected)
+		}
+	})
+}
@@ -1,8 +1,14 @@
 package socks
 
 import (
+	"bytes"
+	"io"
+	"net"
+	"strings"
 	"testing"
+	"testing/iotest"
 
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/require"
 )
 
@@ -20,8 +26,111 @@ func TestPackHostData(t *testing.T) {
 			0x01, 0xBB},
 	}
 	for host, expected := range testData {
-		b, err := packHostData(host, 443)
+		addr, err := NewAddr(host, 443)
+		require.NoError(t, err)
+		b, err := packHostData(addr)
 		require.NoError(t, err)
 		require.Equal(t, expected, b)
 	}
 }
+
+func TestUnpackHostData(t *testing.T) {
+	for _, target := range []string{
+		"1.1.1.1:443",
+		"[::1]:443",
+		"[2001:db8::1]:65535",
+		"google.com:443",
+		"under_score.example.com.:1",
+		strings.Repeat("a", 63) + ".com:80",
+	} {
+		addr, err := ParseAddr(target)
+		require.NoError(t, err)
+		b, err := packHostData(addr)
+		require.NoError(t, err)
+		// short reads are possible on QUIC streams
+		unpacked, err := unpackHostData(iotest.OneByteReader(bytes.NewReader(b)))
+		require.NoError(t, err)
+		require.Equal(t, target, unpacked.String())
+	}
+}
+
+func TestUnpackHostData_Invalid(t *testing.T) {
+	testData := map[string]struct {
+		data []byte
+		err  error
+	}{
+		"invalid type":      {[]byte{0xFF, 0x01, 0xBB}, ErrInvalidType},
+		"zero FQDN length":  {[]byte{typeFQDN, 0x00, 0x01, 0xBB}, ErrInvalidFQDN},
+		"invalid character": {[]byte{typeFQDN, 0x03, 'a', '/', 'b', 0x01, 0xBB}, ErrInvalidFQDN},
+		"empty label":       {[]byte{typeFQDN, 0x03, 'a', '.', '.', 0x01, 0xBB}, ErrInvalidFQDN},
+		"hyphen label":      {[]byte{typeFQDN, 0x02, 'a', '-', 0x01, 0xBB}, ErrInvalidFQDN},
+		"zero port":         {[]byte{typeIPv4, 0x01, 0x01, 0x01, 0x01, 0x00, 0x00}, ErrInvalidPort},
+		"short IPv4":        {[]byte{typeIPv4, 0x01, 0x01}, io.ErrUnexpectedEOF},
+		"short FQDN":        {[]byte{typeFQDN, 0x05, 'a'}, io.ErrUnexpectedEOF},
+		"no port":           {[]byte{typeIPv4, 0x01, 0x01, 0x01, 0x01}, io.EOF},
+		"empty":             {nil, io.EOF},
+	}
+	for name, td := range testData {
+		t.Run(name, func(t *testing.T) {
+			_, err := unpackHostData(bytes.NewReader(td.data))
+			require.Equal(t, td.err, err)
+		})
+	}
+}
+
+func TestPackHostData_Invalid(t *testing.T) {
+	for _, addr := range []*Addr{
+		{FQDN: "google.com"},
+		{FQDN: "", Port: 443},
+		{FQDN: strings.Repeat("a", 64) + ".com", Port: 443},
+		{FQDN: "a b.com", Port: 443},
+		{IP: net.IP{1, 2, 3}, Port: 443},
+	} {
+		_, err := packHostData(addr)
+		require.Error(t, err)
+	}
+}
+
+func TestPackAddr(t *testing.T) {
+	// the bound address can be with port 0
+	for _, addr := range []*Addr{
+		{IP: net.IPv4zero},
+		{IP: net.ParseIP("::1"), Port: 443},
+		{FQDN: "google.com"},
+	} {
+		b, err := packAddr(addr)
+		require.NoError(t, err)
+		unpacked, err := unpackAddr(bytes.NewReader(b))
+		require.NoError(t, err)
+		require.Equal(t, addr.String(), unpacked.String())
+	}
+}
+
+func TestResponse(t *testing.T) {
+	testData := map[error]uint8{
+		ErrInvalidHost:     0x08,
+		ErrConnectFailed:   0x01,
+		ErrNetUnreachable:  0x03,
+		ErrHostUnreachable: 0x04,
+		ErrConnRefused:     0x05,
+		ErrTimeout:         0x06,
+		ErrDNSFailure:      0x04,
+		ErrNotAllowed:      0x02,
+		ErrQuotaExceeded:   0x02,
+		ErrListenFailed:    0x01,
+	}
+	for err, reply := range testData {
+		resp := err.(Response)
+		require.Equal(t, reply, resp.SOCKS5Reply(), err.Error())
+		require.NotEqual(t, "unknown error", err.Error())
+		// the response from the server can be checked by errors.Is
+		require.True(t, errors.Is(Response(resp), err))
+		require.True(t, errors.Is(errors.WithMessage(resp, "test"), err))
+		// the reply from the SOCKS5 upstream proxy
+		switch err {
+		case ErrConnectFailed, ErrDNSFailure, ErrQuotaExceeded, ErrListenFailed:
+		default:
+			require.Equal(t, resp, responseFromSOCKS5Reply(reply))
+		}
+	}
+}
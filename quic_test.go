@@ -1,50 +1,491 @@
 package socks
 
 import (
-	"context"
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
 	"crypto/tls"
 	"crypto/x509"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"net"
 	"net/http"
-	"strconv"
+	"net/http/httptest"
+	"runtime"
 	"testing"
 	"time"
+	"unsafe"
 
 	"github.com/stretchr/testify/require"
 )
 
-func TestClient_Connect(t *testing.T) {
-	// generate server
-	tlsCert, err := tls.LoadX509KeyPair("testdata/cert.pem", "testdata/key.pem")
+// testServer is used to start a server on an ephemeral port
+// and create a client about it, the password is "test".
+func testServer(t *testing.T) (*Server, *Client) {
+	server, err := NewServer("localhost:0", []byte("test"), testServerTLS(t))
 	require.NoError(t, err)
-	serverTLS := tls.Config{Certificates: []tls.Certificate{tlsCert}}
-	server, err := NewServer("localhost:8989", []byte("test"), &serverTLS)
-	require.NoError(t, err)
-	defer server.Close()
+	require.NoError(t, server.ListenTCP("localhost:0"))
 	go func() { _ = server.ListenAndServe() }()
-	time.Sleep(250 * time.Millisecond)
 
-	clientTLS := tls.Config{RootCAs: x509.NewCertPool()}
+	client, err := NewClient(server.Addr().String(), []byte("test"), testClientTLS(t))
+	require.NoError(t, err)
+	return server, client
+}
+
+// testServerTLS is used to create the server TLS config about testdata.
+func testServerTLS(t *testing.T) *tls.Config {
+	tlsCert, err := tls.LoadX509KeyPair("testdata/cert.pem", "testdata/key.pem")
+	require.NoError(t, err)
+	return &tls.Config{Certificates: []tls.Certificate{tlsCert}}
+}
+
+// testClientTLS is used to create the client TLS config about testdata.
+func testClientTLS(t *testing.T) *tls.Config {
+	tlsCert, err := tls.LoadX509KeyPair("testdata/cert.pem", "testdata/key.pem")
+	require.NoError(t, err)
 	cert, err := x509.ParseCertificate(tlsCert.Certificate[0])
+	require.NoError(t, err)
+	clientTLS := tls.Config{
+		RootCAs:    x509.NewCertPool(),
+		ServerName: "localhost",
+	}
 	clientTLS.RootCAs.AddCert(cert)
-	client, err := NewClient("localhost:8989", []byte("test"), &clientTLS)
+	return &clientTLS
+}
+
+func TestClient_Connect(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte("hello"))
+	}))
+	defer target.Close()
+	server, client := testServer(t)
+	defer server.Close()
 
 	hc := http.Client{Timeout: 15 * time.Second}
 	defer hc.CloseIdleConnections()
 	hc.Transport = &http.Transport{
-		DialContext: func(_ context.Context, _, addr string) (net.Conn, error) {
-			host, port, _ := net.SplitHostPort(addr)
-			i, _ := strconv.Atoi(port)
+		Dial: func(_, addr string) (net.Conn, error) {
+			host, port := splitTarget(t, addr)
 			conn, err := client.Dial()
-			require.NoError(t, err)
-			return Connect(conn, host, uint16(i))
+			if err != nil {
+				return nil, err
+			}
+			return Connect(conn, host, port)
 		},
 	}
-	resp, err := hc.Get("https://github.com/")
+	resp, err := hc.Get(target.URL)
 	require.NoError(t, err)
 	defer func() { _ = resp.Body.Close() }()
 	b, err := ioutil.ReadAll(resp.Body)
 	require.NoError(t, err)
-	t.Log(string(b))
+	require.Equal(t, "hello", string(b))
+}
+
+func TestClient_DialConnect(t *testing.T) {
+	echo := testListen(t, testEcho)
+	defer func() { _ = echo.Close() }()
+	server, client := testServer(t)
+	defer server.Close()
+
+	host, port := splitTarget(t, echo.Addr().String())
+	conn, err := client.DialConnect(host, port, []byte("hello"))
+	require.NoError(t, err)
+	defer func() { _ = conn.Close() }()
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(conn, buf)
+	require.NoError(t, err)
+	require.Equal(t, "hello", string(buf))
+
+	// connect with payload after authenticated
+	conn, err = client.Dial()
+	require.NoError(t, err)
+	conn, err = ConnectWithPayload(conn, host, port, []byte("world"))
+	require.NoError(t, err)
+	defer func() { _ = conn.Close() }()
+	_, err = io.ReadFull(conn, buf)
+	require.NoError(t, err)
+	require.Equal(t, "world", string(buf))
+}
+
+// testDidResume is used to check the TLS session about conn is resumed.
+func testDidResume(t *testing.T, conn net.Conn) bool {
+	switch session := conn.(*Conn).session.(type) {
+	case *quicSession:
+		return session.ConnectionState().DidResume
+	case *singleStreamSession:
+		return session.stream.Conn.(*tls.Conn).ConnectionState().DidResume
+	default:
+		t.Fatalf("unexpected session %T", session)
+		return false
+	}
+}
+
+func TestClient_SessionResumption(t *testing.T) {
+	server, quicClient := testServer(t)
+	defer server.Close()
+	tcpClient, err := NewClientWithTransport(NewTCPTransport(),
+		server.TCPAddr().String(), []byte("test"), testClientTLS(t))
+	require.NoError(t, err)
+
+	for _, item := range []struct {
+		name   string
+		client *Client
+	}{
+		{"quic", quicClient},
+		{"tcp", tcpClient},
+	} {
+		t.Run(item.name, func(t *testing.T) {
+			// the quic-go in use copies tls.ClientSessionState with unsafe,
+			// it is an opaque handle since Go 1.21, so the copied session
+			// is broken and can't be resumed with the newer Go
+			if item.name == "quic" && unsafe.Sizeof(tls.ClientSessionState{}) == unsafe.Sizeof(uintptr(0)) {
+				t.Skip("the quic-go in use can't resume the session with", runtime.Version())
+			}
+			// the session ticket is received after the handshake,
+			// Dial reads the auth response, so it is processed
+			conn, err := item.client.Dial()
+			require.NoError(t, err)
+			require.False(t, testDidResume(t, conn))
+			_ = conn.Close()
+
+			conn, err = item.client.Dial()
+			require.NoError(t, err)
+			require.True(t, testDidResume(t, conn))
+			_ = conn.Close()
+		})
+	}
+}
+
+func TestConn_CloseWrite(t *testing.T) {
+	// the target replies after read EOF
+	target := testListen(t, func(conn net.Conn) {
+		b, err := ioutil.ReadAll(conn)
+		if err != nil {
+			return
+		}
+		_, _ = conn.Write(append([]byte("reply "), b...))
+	})
+	defer func() { _ = target.Close() }()
+	server, client := testServer(t)
+	defer server.Close()
+
+	host, port := splitTarget(t, target.Addr().String())
+	conn, err := client.DialConnect(host, port, []byte("hello"))
+	require.NoError(t, err)
+	defer func() { _ = conn.Close() }()
+	require.NoError(t, conn.(*Conn).CloseWrite())
+	_ = conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	b, err := ioutil.ReadAll(conn)
+	require.NoError(t, err)
+	require.Equal(t, "reply hello", string(b))
+}
+
+func TestServer_AuthFailure(t *testing.T) {
+	t.Run("default", func(t *testing.T) {
+		server, client := testServer(t)
+		defer server.Close()
+
+		// the server doesn't reply the invalid password and
+		// closes the connection after read the padding
+		conn, err := client.dial()
+		require.NoError(t, err)
+		defer func() { _ = conn.Close() }()
+		data := make([]byte, sha256.Size+256+1024)
+		_, err = rand.Read(data)
+		require.NoError(t, err)
+		_, err = conn.Write(data)
+		require.NoError(t, err)
+		_ = conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+		_, err = conn.Read(make([]byte, 1))
+		require.Error(t, err)
+		require.NotContains(t, err.Error(), "deadline")
+	})
+
+	// testFallback is used to create the server that the fallback
+	// handler replies the data read after the prefix is checked
+	testFallback := func(t *testing.T, prefix []byte) (*Server, *Client) {
+		server, client := testServer(t)
+		server.SetFallback(func(conn net.Conn) {
+			b := make([]byte, len(prefix)+5)
+			_, err := io.ReadFull(conn, b)
+			if err != nil || !bytes.Equal(b[:len(prefix)], prefix) {
+				return
+			}
+			_, _ = conn.Write(b[len(prefix):])
+		})
+		return server, client
+	}
+
+	t.Run("fallback", func(t *testing.T) {
+		data := make([]byte, sha256.Size+256)
+		_, err := rand.Read(data)
+		require.NoError(t, err)
+		server, client := testFallback(t, data)
+		defer server.Close()
+
+		conn, err := client.dial()
+		require.NoError(t, err)
+		defer func() { _ = conn.Close() }()
+		_, err = conn.Write(append(data, "hello"...))
+		require.NoError(t, err)
+		_ = conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+		buf := make([]byte, 5)
+		_, err = io.ReadFull(conn, buf)
+		require.NoError(t, err)
+		require.Equal(t, "hello", string(buf))
+	})
+
+	t.Run("short request", func(t *testing.T) {
+		server, client := testFallback(t, nil)
+		defer server.Close()
+
+		// shorter than the password hash, then close write
+		conn, err := client.dial()
+		require.NoError(t, err)
+		defer func() { _ = conn.Close() }()
+		_, err = conn.Write([]byte("hello"))
+		require.NoError(t, err)
+		require.NoError(t, conn.CloseWrite())
+		_ = conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+		b, err := ioutil.ReadAll(conn)
+		require.NoError(t, err)
+		require.Equal(t, "hello", string(b))
+	})
+
+	t.Run("foreign stream", func(t *testing.T) {
+		server, client := testFallback(t, []byte{0x01})
+		defer server.Close()
+
+		// like an HTTP/3 request, the first byte is not written by OpenStream
+		session, err := client.transport.Dial(client.address, client.tlsConfig)
+		require.NoError(t, err)
+		defer func() { _ = session.Close() }()
+		stream, err := session.(*quicSession).Session.OpenStreamSync()
+		require.NoError(t, err)
+		_, err = stream.Write([]byte("\x01hello"))
+		require.NoError(t, err)
+		_ = stream.SetReadDeadline(time.Now().Add(10 * time.Second))
+		buf := make([]byte, 5)
+		_, err = io.ReadFull(stream, buf)
+		require.NoError(t, err)
+		require.Equal(t, "hello", string(buf))
+	})
+}
+
+func TestServer_AuthPadding(t *testing.T) {
+	echo := testListen(t, testEcho)
+	defer func() { _ = echo.Close() }()
+	server, _ := testServer(t)
+	defer server.Close()
+	for i := 0; i < 100; i++ {
+		name := fmt.Sprintf("user%d", i)
+		require.NoError(t, server.SetUser(name, &User{Password: name}))
+	}
+	client, err := NewClient(server.Addr().String(), []byte("user99"), testClientTLS(t))
+	require.NoError(t, err)
+	host, port := splitTarget(t, echo.Addr().String())
+
+	conn, err := client.DialConnect(host, port, []byte("hello"))
+	require.NoError(t, err)
+	defer func() { _ = conn.Close() }()
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(conn, buf)
+	require.NoError(t, err)
+	require.Equal(t, "hello", string(buf))
+
+	// the hash is only checked at the padding size in the first byte
+	data := client.authData()
+	require.Equal(t, len(data)-sha256.Size-minPaddingSize, int(data[sha256.Size]))
+	data[sha256.Size]--
+	raw, err := client.dial()
+	require.NoError(t, err)
+	defer func() { _ = raw.Close() }()
+	_, err = raw.Write(data)
+	require.NoError(t, err)
+	require.NoError(t, raw.CloseWrite())
+	_ = raw.SetReadDeadline(time.Now().Add(10 * time.Second))
+	_, err = raw.Read(make([]byte, 1))
+	require.Error(t, err)
+	require.NotContains(t, err.Error(), "deadline")
+}
+
+func TestServer_InvalidHost(t *testing.T) {
+	server, client := testServer(t)
+	defer server.Close()
+
+	conn, err := client.Dial()
+	require.NoError(t, err)
+	defer func() { _ = conn.Close() }()
+	_, err = conn.Write([]byte{0xFF, 0x00, 0x00})
+	require.NoError(t, err)
+	resp := make([]byte, respSize)
+	_, err = io.ReadFull(conn, resp)
+	require.NoError(t, err)
+	require.Equal(t, respInvalidHost, resp[0])
+}
+
+func TestServer_ConnectFailed(t *testing.T) {
+	// get a closed port
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	host, port := splitTarget(t, listener.Addr().String())
+	require.NoError(t, listener.Close())
+	server, client := testServer(t)
+	defer server.Close()
+
+	conn, err := client.Dial()
+	require.NoError(t, err)
+	_, err = Connect(conn, host, port)
+	require.Equal(t, ErrConnRefused, err)
+
+	_, err = client.DialConnect(host, port, nil)
+	require.Equal(t, ErrConnRefused, err)
+}
+
+func TestClient_LargeTransfer(t *testing.T) {
+	echo := testListen(t, testEcho)
+	defer func() { _ = echo.Close() }()
+	server, client := testServer(t)
+	defer server.Close()
+
+	host, port := splitTarget(t, echo.Addr().String())
+	conn, err := client.Dial()
+	require.NoError(t, err)
+	conn, err = Connect(conn, host, port)
+	require.NoError(t, err)
+	defer func() { _ = conn.Close() }()
+
+	data := make([]byte, 16*1024*1024)
+	_, err = rand.Read(data)
+	require.NoError(t, err)
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := conn.Write(data)
+		if err == nil {
+			err = conn.(*Conn).CloseWrite()
+		}
+		errCh <- err
+	}()
+	_ = conn.SetReadDeadline(time.Now().Add(time.Minute))
+	received, err := ioutil.ReadAll(conn)
+	require.NoError(t, err)
+	require.NoError(t, <-errCh)
+	require.True(t, bytes.Equal(data, received))
+}
+
+func TestClient_ConnectAddr(t *testing.T) {
+	server, client := testServer(t)
+	defer server.Close()
+
+	for _, address := range []string{"127.0.0.1:0", "[::1]:0"} {
+		t.Run(address, func(t *testing.T) {
+			listener, err := net.Listen("tcp", address)
+			if err != nil {
+				t.Skip(err)
+			}
+			defer func() { _ = listener.Close() }()
+			go func() {
+				conn, err := listener.Accept()
+				if err != nil {
+					return
+				}
+				defer func() { _ = conn.Close() }()
+				testEcho(conn)
+			}()
+
+			conn, err := client.Dial()
+			require.NoError(t, err)
+			conn, err = ConnectAddr(conn, listener.Addr())
+			require.NoError(t, err)
+			defer func() { _ = conn.Close() }()
+			_, err = conn.Write([]byte("hello"))
+			require.NoError(t, err)
+			buf := make([]byte, 5)
+			_, err = io.ReadFull(conn, buf)
+			require.NoError(t, err)
+			require.Equal(t, "hello", string(buf))
+		})
+	}
+}
+
+func TestClient_ConnectBound(t *testing.T) {
+	echo := testListen(t, testEcho)
+	defer func() { _ = echo.Close() }()
+	server, client := testServer(t)
+	defer server.Close()
+
+	check := func(conn net.Conn, bound *Addr) {
+		defer func() { _ = conn.Close() }()
+		require.True(t, bound.IP.IsLoopback())
+		require.NotZero(t, bound.Port)
+		buf := make([]byte, 5)
+		_, err := io.ReadFull(conn, buf)
+		require.NoError(t, err)
+		require.Equal(t, "hello", string(buf))
+	}
+	conn, bound, err := client.DialConnectBound(echo.Addr(), []byte("hello"))
+	require.NoError(t, err)
+	check(conn, bound)
+
+	conn, err = client.Dial()
+	require.NoError(t, err)
+	conn, bound, err = ConnectBound(conn, echo.Addr(), []byte("hello"))
+	require.NoError(t, err)
+	check(conn, bound)
+}
+
+func TestClient_TCPFallback(t *testing.T) {
+	echo := testListen(t, testEcho)
+	defer func() { _ = echo.Close() }()
+	server, _ := testServer(t)
+	defer server.Close()
+	// UDP is blocked, the packets are dropped
+	blocked, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer func() { _ = blocked.Close() }()
+	client, err := NewClient(blocked.LocalAddr().String(), []byte("test"), testClientTLS(t))
+	require.NoError(t, err)
+	client.SetTCPFallback(&TCPFallbackOptions{
+		Address:          server.TCPAddr().String(),
+		HandshakeTimeout: 500 * time.Millisecond,
+	})
+
+	host, port := splitTarget(t, echo.Addr().String())
+	for i := 0; i < 2; i++ {
+		start := time.Now()
+		conn, err := client.DialConnect(host, port, []byte("hello"))
+		require.NoError(t, err)
+		if i == 1 {
+			// the fallback is remembered, QUIC is not tried
+			require.True(t, time.Since(start) < 500*time.Millisecond)
+		}
+		buf := make([]byte, 5)
+		_, err = io.ReadFull(conn, buf)
+		require.NoError(t, err)
+		require.Equal(t, "hello", string(buf))
+		require.NoError(t, closeWrite(conn))
+		_, err = ioutil.ReadAll(conn)
+		require.NoError(t, err)
+		_ = conn.Close()
+	}
+}
+
+func TestTCPTransport_ALPN(t *testing.T) {
+	server, _ := testServer(t)
+	defer server.Close()
+
+	// the listener looks like an HTTPS server instead of HTTP/3
+	for _, protos := range [][]string{{"h2", "http/1.1"}, {nextProto}} {
+		tlsConfig := testClientTLS(t)
+		tlsConfig.NextProtos = protos
+		conn, err := tls.Dial("tcp", server.TCPAddr().String(), tlsConfig)
+		if protos[0] == nextProto {
+			require.Error(t, err)
+			continue
+		}
+		require.NoError(t, err)
+		require.Equal(t, "h2", conn.ConnectionState().NegotiatedProtocol)
+		_ = conn.Close()
+	}
 }
@@ -0,0 +1,231 @@
+package socks
+
+import (
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const defaultBufferSize = 32 * 1024
+
+var errIdleTimeout = errors.New("relay idle timeout")
+
+// bufferPools are the pools about relay buffers, key is the buffer size.
+var bufferPools sync.Map
+
+func getBuffer(size int) *[]byte {
+	pool, ok := bufferPools.Load(size)
+	if !ok {
+		pool, _ = bufferPools.LoadOrStore(size, &sync.Pool{
+			New: func() interface{} {
+				b := make([]byte, size)
+				return &b
+			},
+		})
+	}
+	return pool.(*sync.Pool).Get().(*[]byte)
+}
+
+func putBuffer(b *[]byte) {
+	if pool, ok := bufferPools.Load(len(*b)); ok {
+		pool.(*sync.Pool).Put(b)
+	}
+}
+
+// CloseReason is the reason about why the relay is finished.
+type CloseReason uint8
+
+// reasons about Relay.
+const (
+	CloseEOF         CloseReason = iota // both sides closed normally
+	CloseIdle                           // no data in both directions until idle timeout
+	CloseConnError                      // failed to read from or write to conn
+	CloseRemoteError                    // failed to read from or write to remote
+)
+
+func (r CloseReason) String() string {
+	switch r {
+	case CloseEOF:
+		return "eof"
+	case CloseIdle:
+		return "idle timeout"
+	case CloseConnError:
+		return "conn error"
+	case CloseRemoteError:
+		return "remote error"
+	default:
+		return "unknown"
+	}
+}
+
+// RelayOptions contains options about Relay.
+type RelayOptions struct {
+	// IdleTimeout is the maximum time without data in both
+	// directions, default is 5 minutes, negative will disable it
+	IdleTimeout time.Duration
+
+	// BufferSize is the size of the buffer per direction, default is
+	// 32 KiB, buffers are reused by the relays with the same size
+	BufferSize int
+
+	// Upload and Download are the atomic counters updated
+	// during the relay, they can be nil
+	Upload   *uint64
+	Download *uint64
+}
+
+// RelayResult is the result about Relay.
+type RelayResult struct {
+	Upload   int64 // conn -> remote
+	Download int64 // remote -> conn
+	Reason   CloseReason
+	Err      error // the first error, nil if Reason is CloseEOF
+}
+
+type relay struct {
+	active int64 // last active time, unix nano, atomic
+
+	conn       net.Conn
+	remote     net.Conn
+	bufferSize int
+	result     RelayResult
+
+	reasonOnce sync.Once
+	closeOnce  sync.Once
+	closed     chan struct{}
+}
+
+// Relay is used to copy data between conn and remote until both directions
+// are finished, the EOF is propagated to the other side by CloseWrite. If
+// the write side aborts, such as the peer stops reading, the source is
+// closed by CloseRead and the other direction continues. If the read side
+// is failed or the relay is idle, both sides will be closed. The caller
+// still needs to close conn and remote, opts can be nil.
+func Relay(conn, remote net.Conn, opts *RelayOptions) *RelayResult {
+	if opts == nil {
+		opts = new(RelayOptions)
+	}
+	r := relay{
+		active:     time.Now().UnixNano(),
+		conn:       conn,
+		remote:     remote,
+		bufferSize: opts.BufferSize,
+		closed:     make(chan struct{}),
+	}
+	if r.bufferSize <= 0 {
+		r.bufferSize = defaultBufferSize
+	}
+	idleTimeout := opts.IdleTimeout
+	if idleTimeout == 0 {
+		idleTimeout = 5 * time.Minute
+	}
+	wg := sync.WaitGroup{}
+	if idleTimeout > 0 {
+		wg.Add(1)
+		go r.watchIdle(idleTimeout, &wg)
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		r.copy(conn, remote, &r.result.Download, opts.Download, CloseConnError, CloseRemoteError)
+	}()
+	r.copy(remote, conn, &r.result.Upload, opts.Upload, CloseRemoteError, CloseConnError)
+	<-done
+	r.closeOnce.Do(func() { close(r.closed) })
+	wg.Wait()
+	return &r.result
+}
+
+// copy is used to copy data from src to dst, dstReason and srcReason
+// are the reasons about the write error and the read error.
+//
+// It doesn't use TCPConn.ReadFrom(splice on Linux) even if both sides
+// are *net.TCPConn, it only splices when src is a bare *net.TCPConn, so
+// the live counters and the activity about idle timeout will be lost,
+// and one side is always a QUIC stream in this package.
+func (r *relay) copy(dst, src net.Conn, n *int64, counter *uint64, dstReason, srcReason CloseReason) {
+	buf := getBuffer(r.bufferSize)
+	defer putBuffer(buf)
+	for {
+		nr, er := src.Read(*buf)
+		if nr > 0 {
+			atomic.StoreInt64(&r.active, time.Now().UnixNano())
+			nw, ew := dst.Write((*buf)[:nr])
+			atomic.AddInt64(n, int64(nw))
+			if counter != nil {
+				atomic.AddUint64(counter, uint64(nw))
+			}
+			if ew == nil && nw != nr {
+				ew = io.ErrShortWrite
+			}
+			if ew != nil {
+				// stop the peer about src sending the data that
+				// can't be delivered, like TCP shutdown read
+				r.record(dstReason, ew)
+				_ = closeRead(src)
+				return
+			}
+		}
+		if er == io.EOF {
+			_ = closeWrite(dst)
+			return
+		}
+		if er != nil {
+			r.abort(srcReason, er)
+			return
+		}
+	}
+}
+
+// record is used to record the reason, only the first one is recorded.
+func (r *relay) record(reason CloseReason, err error) {
+	r.reasonOnce.Do(func() {
+		r.result.Reason = reason
+		r.result.Err = err
+	})
+}
+
+// abort is used to close both sides for stop the other direction.
+func (r *relay) abort(reason CloseReason, err error) {
+	r.record(reason, err)
+	r.closeOnce.Do(func() {
+		close(r.closed)
+		_ = r.conn.Close()
+		_ = r.remote.Close()
+	})
+}
+
+func (r *relay) watchIdle(timeout time.Duration, wg *sync.WaitGroup) {
+	defer wg.Done()
+	ticker := time.NewTicker(checkInterval(timeout))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			active := time.Unix(0, atomic.LoadInt64(&r.active))
+			if time.Since(active) > timeout {
+				r.abort(CloseIdle, errIdleTimeout)
+				return
+			}
+		case <-r.closed:
+			return
+		}
+	}
+}
+
+// checkInterval is the interval about check idle, it is not
+// larger than a second for make the idle timeout accurate.
+func checkInterval(timeout time.Duration) time.Duration {
+	interval := timeout / 10
+	if interval > time.Second {
+		return time.Second
+	}
+	if interval < time.Millisecond {
+		return time.Millisecond
+	}
+	return interval
+}
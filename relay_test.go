@@ -0,0 +1,232 @@
+package socks
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+// testTCPPair is used to create a pair of connected TCP connections.
+func testTCPPair(t testing.TB) (net.Conn, net.Conn) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer func() { _ = listener.Close() }()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			close(accepted)
+			return
+		}
+		accepted <- conn
+	}()
+	client, err := net.Dial("tcp", listener.Addr().String())
+	require.NoError(t, err)
+	server := <-accepted
+	require.NotNil(t, server)
+	return client, server
+}
+
+func TestRelay(t *testing.T) {
+	t.Run("half-close", func(t *testing.T) {
+		app, conn := testTCPPair(t)
+		remote, target := testTCPPair(t)
+		defer func() {
+			_ = app.Close()
+			_ = conn.Close()
+			_ = remote.Close()
+			_ = target.Close()
+		}()
+		// the target replies after read EOF
+		go func() {
+			b, _ := ioutil.ReadAll(target)
+			_, _ = target.Write(append([]byte("reply "), b...))
+			_ = target.Close()
+		}()
+		var upload, download uint64
+		results := make(chan *RelayResult, 1)
+		go func() {
+			results <- Relay(conn, remote, &RelayOptions{
+				Upload:   &upload,
+				Download: &download,
+			})
+		}()
+		_, err := app.Write([]byte("hello"))
+		require.NoError(t, err)
+		require.NoError(t, app.(*net.TCPConn).CloseWrite())
+		b, err := ioutil.ReadAll(app)
+		require.NoError(t, err)
+		require.Equal(t, "reply hello", string(b))
+
+		result := <-results
+		require.Equal(t, CloseEOF, result.Reason)
+		require.NoError(t, result.Err)
+		require.Equal(t, int64(5), result.Upload)
+		require.Equal(t, int64(11), result.Download)
+		require.Equal(t, uint64(5), atomic.LoadUint64(&upload))
+		require.Equal(t, uint64(11), atomic.LoadUint64(&download))
+	})
+
+	t.Run("idle timeout", func(t *testing.T) {
+		app, conn := testTCPPair(t)
+		remote, target := testTCPPair(t)
+		defer func() {
+			_ = app.Close()
+			_ = target.Close()
+		}()
+		start := time.Now()
+		result := Relay(conn, remote, &RelayOptions{IdleTimeout: 100 * time.Millisecond})
+		require.Equal(t, CloseIdle, result.Reason)
+		require.Error(t, result.Err)
+		require.True(t, time.Since(start) < 5*time.Second)
+		// both sides are closed
+		_, err := ioutil.ReadAll(app)
+		require.NoError(t, err)
+		_, err = ioutil.ReadAll(target)
+		require.NoError(t, err)
+	})
+
+	t.Run("remote error", func(t *testing.T) {
+		app, conn := testTCPPair(t)
+		remote, target := testTCPPair(t)
+		defer func() {
+			_ = app.Close()
+			_ = target.Close()
+		}()
+		// reset the connection about remote
+		require.NoError(t, target.(*net.TCPConn).SetLinger(0))
+		require.NoError(t, target.Close())
+		result := Relay(conn, remote, nil)
+		require.Equal(t, CloseRemoteError, result.Reason)
+		require.Error(t, result.Err)
+		// the other side is closed
+		_, err := ioutil.ReadAll(app)
+		require.NoError(t, err)
+	})
+	t.Run("stop sending", func(t *testing.T) {
+		app, conn := testTCPPair(t)
+		remote, target := testTCPPair(t)
+		defer func() {
+			_ = app.Close()
+			_ = target.Close()
+		}()
+		// the peer about remote stops reading but still replies
+		stopped := &testStopConn{Conn: remote}
+		recorder := &testCloseReadConn{Conn: conn}
+		results := make(chan *RelayResult, 1)
+		go func() { results <- Relay(recorder, stopped, nil) }()
+		_, err := app.Write([]byte("hello"))
+		require.NoError(t, err)
+		_, err = target.Write([]byte("reply"))
+		require.NoError(t, err)
+		require.NoError(t, target.Close())
+		b, err := ioutil.ReadAll(app)
+		require.NoError(t, err)
+		require.Equal(t, "reply", string(b))
+
+		result := <-results
+		require.Equal(t, CloseRemoteError, result.Reason)
+		require.Equal(t, errTestStopSending, result.Err)
+		require.Equal(t, int64(5), result.Download)
+		require.Equal(t, int32(1), atomic.LoadInt32(&recorder.closeRead))
+	})
+}
+
+var errTestStopSending = errors.New("stop sending")
+
+// testStopConn is the conn that the peer stops reading.
+type testStopConn struct {
+	net.Conn
+}
+
+func (c *testStopConn) Write([]byte) (int, error) {
+	return 0, errTestStopSending
+}
+
+func (c *testStopConn) CloseWrite() error {
+	return closeWrite(c.Conn)
+}
+
+// testCloseReadConn is used to count the calls about CloseRead.
+type testCloseReadConn struct {
+	net.Conn
+	closeRead int32
+}
+
+func (c *testCloseReadConn) CloseWrite() error {
+	return closeWrite(c.Conn)
+}
+
+func (c *testCloseReadConn) CloseRead() error {
+	atomic.AddInt32(&c.closeRead, 1)
+	return closeRead(c.Conn)
+}
+
+// testCopyRelay is the relay before the buffer pool, as the baseline.
+func testCopyRelay(conn, remote net.Conn) {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_, _ = io.Copy(conn, remote)
+	}()
+	_, _ = io.Copy(remote, conn)
+	<-done
+}
+
+// testClosedPipe is used to create a conn that the peer is closed.
+func testClosedPipe() net.Conn {
+	conn, peer := net.Pipe()
+	_ = peer.Close()
+	return conn
+}
+
+func BenchmarkRelay_Throughput(b *testing.B) {
+	for _, size := range []int{4 * 1024, 32 * 1024, 128 * 1024} {
+		b.Run(fmt.Sprintf("%dKiB", size/1024), func(b *testing.B) {
+			app, conn := testTCPPair(b)
+			remote, target := testTCPPair(b)
+			defer func() {
+				_ = conn.Close()
+				_ = remote.Close()
+			}()
+			go Relay(conn, remote, &RelayOptions{BufferSize: size})
+			go func() { _, _ = io.Copy(ioutil.Discard, target) }()
+
+			data := make([]byte, 64*1024)
+			b.SetBytes(int64(len(data)))
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				_, err := app.Write(data)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.StopTimer()
+			_ = app.Close()
+			_ = target.Close()
+		})
+	}
+}
+
+func BenchmarkRelay_Alloc(b *testing.B) {
+	b.Run("pool", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			Relay(testClosedPipe(), testClosedPipe(), &RelayOptions{IdleTimeout: -1})
+		}
+	})
+	b.Run("io.Copy", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			testCopyRelay(testClosedPipe(), testClosedPipe())
+		}
+	})
+}
@@ -0,0 +1,530 @@
+package socks
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ResolverOptions contains options about the DNS resolver of the server.
+type ResolverOptions struct {
+	// Servers are the upstream DNS servers, it can be "8.8.8.8:53",
+	// "udp://8.8.8.8:53", "tcp://8.8.8.8:53", "tls://1.1.1.1:853"
+	// (DNS-over-TLS) or "https://1.1.1.1/dns-query"(DNS-over-HTTPS),
+	// if it is empty, the name servers of the system will be used
+	Servers []string
+
+	// Hosts is used to override the resolve result,
+	// key is the host name, value is the IP address list
+	Hosts map[string][]string
+
+	// CacheTTL is the maximum TTL of the successful resolve result,
+	// it is capped by the TTL of the records, zero will disable the
+	// positive cache
+	CacheTTL time.Duration
+
+	// NegativeTTL is the maximum TTL of the not found resolve result,
+	// it is capped by the TTL of the SOA record in the response, zero
+	// will disable the negative cache
+	NegativeTTL time.Duration
+
+	// Timeout is the timeout of each query, default is 5s
+	Timeout time.Duration
+}
+
+// Resolver is a DNS resolver with the custom upstream servers and cache.
+type Resolver struct {
+	servers     []*dnsServer
+	next        uint32 // for select server
+	hosts       map[string][]net.IP
+	cacheTTL    time.Duration
+	negativeTTL time.Duration
+	timeout     time.Duration
+	resolver    *net.Resolver
+
+	cache    map[string]*dnsCache
+	cacheRWM sync.RWMutex
+
+	// the minimum TTL of the responses about the host
+	// that is resolving, it caps the cache time
+	ttls   map[string]time.Duration
+	ttlsMu sync.Mutex
+
+	// name servers in /etc/resolv.conf for Exchange
+	system     []*dnsServer
+	systemErr  error
+	systemOnce sync.Once
+}
+
+type dnsServer struct {
+	network string // udp, tcp, tls or https
+	address string // host:port or URL
+	client  *http.Client
+}
+
+type dnsCache struct {
+	ips    []net.IP
+	err    error
+	expire time.Time
+}
+
+// NewResolver is used to create a DNS resolver, opts can be nil.
+func NewResolver(opts *ResolverOptions) (*Resolver, error) {
+	if opts == nil {
+		opts = new(ResolverOptions)
+	}
+	r := Resolver{
+		hosts:       make(map[string][]net.IP),
+		cacheTTL:    opts.CacheTTL,
+		negativeTTL: opts.NegativeTTL,
+		timeout:     opts.Timeout,
+		cache:       make(map[string]*dnsCache),
+		ttls:        make(map[string]time.Duration),
+	}
+	if r.timeout <= 0 {
+		r.timeout = 5 * time.Second
+	}
+	for _, server := range opts.Servers {
+		s, err := parseDNSServer(server)
+		if err != nil {
+			return nil, err
+		}
+		r.servers = append(r.servers, s)
+	}
+	for host, addrs := range opts.Hosts {
+		var ips []net.IP
+		for _, addr := range addrs {
+			ip := net.ParseIP(addr)
+			if ip == nil {
+				return nil, errors.Errorf("invalid IP address \"%s\" about host %s", addr, host)
+			}
+			ips = append(ips, ip)
+		}
+		r.hosts[normalizeHost(host)] = ips
+	}
+	// use the Go resolver for read the TTL about the responses
+	r.resolver = &net.Resolver{
+		PreferGo: true,
+		Dial:     r.dial,
+	}
+	return &r, nil
+}
+
+func parseDNSServer(server string) (*dnsServer, error) {
+	if !strings.Contains(server, "://") {
+		server = "udp://" + server
+	}
+	u, err := url.Parse(server)
+	if err != nil {
+		return nil, err
+	}
+	s := dnsServer{network: u.Scheme}
+	switch u.Scheme {
+	case "udp", "tcp":
+		s.address = withDefaultPort(u.Host, "53")
+	case "tls":
+		s.address = withDefaultPort(u.Host, "853")
+	case "https":
+		s.address = u.String()
+		s.client = &http.Client{
+			Transport: &http.Transport{
+				ForceAttemptHTTP2:   true,
+				MaxIdleConnsPerHost: 4,
+				IdleConnTimeout:     time.Minute,
+			},
+		}
+	default:
+		return nil, errors.Errorf("unsupported DNS server \"%s\"", server)
+	}
+	return &s, nil
+}
+
+func withDefaultPort(host, port string) string {
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return host
+	}
+	return net.JoinHostPort(strings.Trim(host, "[]"), port)
+}
+
+func normalizeHost(host string) string {
+	return strings.ToLower(strings.TrimSuffix(host, "."))
+}
+
+// LookupIP is used to resolve the host, the result will be cached.
+func (r *Resolver) LookupIP(ctx context.Context, host string) ([]net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+	host = normalizeHost(host)
+	if ips, ok := r.hosts[host]; ok {
+		return ips, nil
+	}
+	r.cacheRWM.RLock()
+	cache, ok := r.cache[host]
+	r.cacheRWM.RUnlock()
+	if ok && time.Now().Before(cache.expire) {
+		return cache.ips, cache.err
+	}
+	addrs, err := r.resolver.LookupIPAddr(ctx, host)
+	var ips []net.IP
+	for i := 0; i < len(addrs); i++ {
+		ips = append(ips, addrs[i].IP)
+	}
+	var ttl time.Duration
+	if err == nil {
+		ttl = r.cacheTTL
+	} else if dnsErr, ok := err.(*net.DNSError); ok && dnsErr.IsNotFound {
+		ttl = r.negativeTTL
+	}
+	if recordTTL, ok := r.takeTTL(host); ok && recordTTL < ttl {
+		ttl = recordTTL
+	}
+	if ttl > 0 {
+		r.cacheRWM.Lock()
+		defer r.cacheRWM.Unlock()
+		r.cache[host] = &dnsCache{ips: ips, err: err, expire: time.Now().Add(ttl)}
+		// clean expired cache
+		if len(r.cache) > 4096 {
+			now := time.Now()
+			for h, c := range r.cache {
+				if now.After(c.expire) {
+					delete(r.cache, h)
+				}
+			}
+		}
+	}
+	return ips, err
+}
+
+// Exchange is used to send a raw DNS message to the upstream DNS server
+// and receive the response, if the Resolver has no upstream servers, the
+// name servers in /etc/resolv.conf will be used.
+func (r *Resolver) Exchange(ctx context.Context, msg []byte) ([]byte, error) {
+	if len(msg) < dnsHeaderSize {
+		return nil, errors.New("DNS message too short")
+	}
+	server, err := r.selectServer()
+	if err != nil {
+		return nil, err
+	}
+	if server.network == "https" {
+		return dohExchange(ctx, server, msg, r.timeout)
+	}
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+	conn, err := r.dialServer(ctx, server)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = conn.Close() }()
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+	if _, ok := conn.(net.PacketConn); ok {
+		_, err = conn.Write(msg)
+		if err != nil {
+			return nil, err
+		}
+		buf := make([]byte, 65535)
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				return nil, err
+			}
+			// skip the response with different id
+			if n >= dnsHeaderSize && buf[0] == msg[0] && buf[1] == msg[1] {
+				return buf[:n], nil
+			}
+		}
+	}
+	err = WriteDNSMessage(conn, msg)
+	if err != nil {
+		return nil, err
+	}
+	return ReadDNSMessage(conn)
+}
+
+func (r *Resolver) selectServer() (*dnsServer, error) {
+	servers := r.servers
+	if len(servers) == 0 {
+		r.systemOnce.Do(func() {
+			r.system, r.systemErr = systemDNSServers()
+		})
+		if r.systemErr != nil {
+			return nil, r.systemErr
+		}
+		servers = r.system
+	}
+	i := atomic.AddUint32(&r.next, 1)
+	return servers[int(i)%len(servers)], nil
+}
+
+// systemDNSServers is used to read name servers in /etc/resolv.conf.
+func systemDNSServers() ([]*dnsServer, error) {
+	data, err := ioutil.ReadFile("/etc/resolv.conf")
+	if err != nil {
+		return nil, err
+	}
+	var servers []*dnsServer
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || fields[0] != "nameserver" {
+			continue
+		}
+		// remove IPv6 zone
+		host := strings.SplitN(fields[1], "%", 2)[0]
+		if net.ParseIP(host) == nil {
+			continue
+		}
+		servers = append(servers, &dnsServer{
+			network: "udp",
+			address: net.JoinHostPort(host, "53"),
+		})
+	}
+	if len(servers) == 0 {
+		return nil, errors.New("no name server in /etc/resolv.conf")
+	}
+	return servers, nil
+}
+
+// recordTTL is used to record the TTL about the response read by
+// net.Resolver, the minimum one is kept until LookupIP takes it.
+func (r *Resolver) recordTTL(resp []byte) {
+	names, err := questionNames(resp)
+	if err != nil || len(names) != 1 {
+		return
+	}
+	ttl, ok := responseTTL(resp)
+	if !ok {
+		return
+	}
+	host := normalizeHost(names[0])
+	r.ttlsMu.Lock()
+	defer r.ttlsMu.Unlock()
+	// the names with the search domain are never taken
+	if len(r.ttls) > 4096 {
+		r.ttls = make(map[string]time.Duration)
+	}
+	if old, ok := r.ttls[host]; ok && old <= ttl {
+		return
+	}
+	r.ttls[host] = ttl
+}
+
+func (r *Resolver) takeTTL(host string) (time.Duration, bool) {
+	r.ttlsMu.Lock()
+	defer r.ttlsMu.Unlock()
+	ttl, ok := r.ttls[host]
+	delete(r.ttls, host)
+	return ttl, ok
+}
+
+// dial is used to connect the upstream DNS server, the address
+// selected by net.Resolver is ignored if the upstream servers are
+// set. A net.PacketConn means UDP message, otherwise message with
+// a 2 bytes length prefix.
+func (r *Resolver) dial(ctx context.Context, network, address string) (net.Conn, error) {
+	var (
+		conn net.Conn
+		err  error
+	)
+	if len(r.servers) == 0 {
+		dialer := net.Dialer{}
+		conn, err = dialer.DialContext(ctx, network, address)
+	} else {
+		var server *dnsServer
+		server, err = r.selectServer()
+		if err != nil {
+			return nil, err
+		}
+		conn, err = r.dialServer(ctx, server)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if udpConn, ok := conn.(*net.UDPConn); ok {
+		return &dnsTTLPacketConn{UDPConn: udpConn, resolver: r}, nil
+	}
+	return &dnsTTLConn{Conn: conn, resolver: r}, nil
+}
+
+// dnsTTLPacketConn is used to record the TTL about the UDP messages.
+type dnsTTLPacketConn struct {
+	*net.UDPConn
+	resolver *Resolver
+}
+
+func (c *dnsTTLPacketConn) Read(b []byte) (int, error) {
+	n, err := c.UDPConn.Read(b)
+	if n > 0 {
+		c.resolver.recordTTL(b[:n])
+	}
+	return n, err
+}
+
+// dnsTTLConn is used to record the TTL about the messages
+// with a 2 bytes length prefix.
+type dnsTTLConn struct {
+	net.Conn
+	resolver *Resolver
+	buf      []byte
+}
+
+func (c *dnsTTLConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.buf = append(c.buf, b[:n]...)
+	for len(c.buf) >= dnsLenSize {
+		l := dnsLenSize + int(binary.BigEndian.Uint16(c.buf))
+		if len(c.buf) < l {
+			break
+		}
+		c.resolver.recordTTL(c.buf[dnsLenSize:l])
+		c.buf = c.buf[l:]
+	}
+	return n, err
+}
+
+func (r *Resolver) dialServer(ctx context.Context, server *dnsServer) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+	dialer := net.Dialer{}
+	switch server.network {
+	case "udp", "tcp":
+		return dialer.DialContext(ctx, server.network, server.address)
+	case "tls":
+		conn, err := dialer.DialContext(ctx, "tcp", server.address)
+		if err != nil {
+			return nil, err
+		}
+		host, _, _ := net.SplitHostPort(server.address)
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: host})
+		if deadline, ok := ctx.Deadline(); ok {
+			_ = tlsConn.SetDeadline(deadline)
+		}
+		err = tlsConn.Handshake()
+		if err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+		_ = tlsConn.SetDeadline(time.Time{})
+		return tlsConn, nil
+	default: // https
+		return newDOHConn(server, r.timeout), nil
+	}
+}
+
+// dohConn is used to send DNS message with DNS-over-HTTPS,
+// it looks like a TCP connection for net.Resolver.
+type dohConn struct {
+	server  *dnsServer
+	timeout time.Duration
+
+	request  bytes.Buffer
+	response *bytes.Reader
+	ctx      context.Context
+	cancel   context.CancelFunc
+}
+
+func newDOHConn(server *dnsServer, timeout time.Duration) *dohConn {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &dohConn{
+		server:  server,
+		timeout: timeout,
+		ctx:     ctx,
+		cancel:  cancel,
+	}
+}
+
+func (c *dohConn) Write(b []byte) (int, error) {
+	if c.ctx.Err() != nil {
+		return 0, ErrConnClosed
+	}
+	return c.request.Write(b)
+}
+
+func (c *dohConn) Read(b []byte) (int, error) {
+	if c.response == nil {
+		resp, err := c.roundTrip()
+		if err != nil {
+			return 0, err
+		}
+		c.response = bytes.NewReader(resp)
+	}
+	return c.response.Read(b)
+}
+
+func (c *dohConn) roundTrip() ([]byte, error) {
+	// remove the length prefix
+	msg := c.request.Bytes()
+	if len(msg) < 2 || int(binary.BigEndian.Uint16(msg)) != len(msg)-2 {
+		return nil, errors.New("invalid DNS message")
+	}
+	resp, err := dohExchange(c.ctx, c.server, msg[2:], c.timeout)
+	if err != nil {
+		return nil, err
+	}
+	// add the length prefix
+	buf := make([]byte, 2+len(resp))
+	binary.BigEndian.PutUint16(buf, uint16(len(resp)))
+	copy(buf[2:], resp)
+	return buf, nil
+}
+
+func dohExchange(ctx context.Context, server *dnsServer, msg []byte, timeout time.Duration) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	req, err := http.NewRequest(http.MethodPost, server.address, bytes.NewReader(msg))
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+	resp, err := server.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("DNS-over-HTTPS server returned %s", resp.Status)
+	}
+	return ioutil.ReadAll(io.LimitReader(resp.Body, 65535))
+}
+
+func (c *dohConn) Close() error {
+	c.cancel()
+	return nil
+}
+
+func (c *dohConn) LocalAddr() net.Addr {
+	return &net.TCPAddr{}
+}
+
+func (c *dohConn) RemoteAddr() net.Addr {
+	return &net.TCPAddr{}
+}
+
+// SetDeadline is not supported, use the timeout of the Resolver.
+func (c *dohConn) SetDeadline(time.Time) error {
+	return nil
+}
+
+func (c *dohConn) SetReadDeadline(time.Time) error {
+	return nil
+}
+
+func (c *dohConn) SetWriteDeadline(time.Time) error {
+	return nil
+}
@@ -0,0 +1,241 @@
+package socks
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseDNSServer(t *testing.T) {
+	testData := map[string][2]string{
+		"8.8.8.8":                   {"udp", "8.8.8.8:53"},
+		"tcp://8.8.8.8":             {"tcp", "8.8.8.8:53"},
+		"tls://1.1.1.1":             {"tls", "1.1.1.1:853"},
+		"tls://[2606:4700::1111]":   {"tls", "[2606:4700::1111]:853"},
+		"udp://8.8.8.8:5353":        {"udp", "8.8.8.8:5353"},
+		"https://1.1.1.1/dns-query": {"https", "https://1.1.1.1/dns-query"},
+	}
+	for server, expected := range testData {
+		s, err := parseDNSServer(server)
+		require.NoError(t, err, server)
+		require.Equal(t, expected[0], s.network, server)
+		require.Equal(t, expected[1], s.address, server)
+	}
+	_, err := parseDNSServer("quic://8.8.8.8")
+	require.Error(t, err)
+}
+
+func TestResolver_Hosts(t *testing.T) {
+	r, err := NewResolver(&ResolverOptions{
+		Hosts: map[string][]string{"Example.COM.": {"1.2.3.4", "::1"}},
+	})
+	require.NoError(t, err)
+	ips, err := r.LookupIP(context.Background(), "example.com")
+	require.NoError(t, err)
+	require.Equal(t, []net.IP{net.ParseIP("1.2.3.4"), net.ParseIP("::1")}, ips)
+	ips, err = r.LookupIP(context.Background(), "127.0.0.1")
+	require.NoError(t, err)
+	require.Equal(t, []net.IP{net.ParseIP("127.0.0.1")}, ips)
+
+	_, err = NewResolver(&ResolverOptions{
+		Hosts: map[string][]string{"example.com": {"1.2.3"}},
+	})
+	require.Error(t, err)
+}
+
+func TestDOHConn(t *testing.T) {
+	query := []byte{1, 2, 3, 4}
+	answer := []byte{5, 6, 7}
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "application/dns-message", r.Header.Get("Content-Type"))
+		b, err := ioutil.ReadAll(r.Body)
+		require.NoError(t, err)
+		require.Equal(t, query, b)
+		_, _ = w.Write(answer)
+	}))
+	defer server.Close()
+	s := dnsServer{network: "https", address: server.URL, client: server.Client()}
+	conn := newDOHConn(&s, 5*time.Second)
+	defer func() { _ = conn.Close() }()
+
+	msg := make([]byte, 2+len(query))
+	binary.BigEndian.PutUint16(msg, uint16(len(query)))
+	copy(msg[2:], query)
+	_, err := conn.Write(msg)
+	require.NoError(t, err)
+	resp := make([]byte, 2+len(answer))
+	_, err = io.ReadFull(conn, resp)
+	require.NoError(t, err)
+	require.Equal(t, uint16(len(answer)), binary.BigEndian.Uint16(resp))
+	require.Equal(t, answer, resp[2:])
+}
+
+// testRecord is a resource record about testDNSResponse.
+type testRecord struct {
+	typ       uint16
+	ttl       uint32
+	rdata     []byte
+	authority bool
+}
+
+// testDNSResponse is used to make the response about the query.
+func testDNSResponse(query []byte, rcode byte, records ...*testRecord) []byte {
+	qEnd := skipName(query, dnsHeaderSize) + 4
+	resp := make([]byte, qEnd)
+	copy(resp, query)
+	resp[2] = 0x81 // QR and RD
+	resp[3] = 0x80 | rcode
+	binary.BigEndian.PutUint16(resp[4:], 1)
+	var anCount, nsCount uint16
+	for _, record := range records {
+		if record.authority {
+			nsCount++
+		} else {
+			anCount++
+		}
+		rr := []byte{0xC0, 0x0C, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0}
+		binary.BigEndian.PutUint16(rr[2:], record.typ)
+		binary.BigEndian.PutUint32(rr[6:], record.ttl)
+		binary.BigEndian.PutUint16(rr[10:], uint16(len(record.rdata)))
+		resp = append(resp, rr...)
+		resp = append(resp, record.rdata...)
+	}
+	binary.BigEndian.PutUint16(resp[6:], anCount)
+	binary.BigEndian.PutUint16(resp[8:], nsCount)
+	binary.BigEndian.PutUint16(resp[10:], 0)
+	return resp
+}
+
+// testSOA is used to make the SOA record with the TTL and MINIMUM.
+func testSOA(ttl, minimum uint32) *testRecord {
+	// root MNAME and RNAME, SERIAL, REFRESH, RETRY, EXPIRE and MINIMUM
+	rdata := make([]byte, 22)
+	binary.BigEndian.PutUint32(rdata[18:], minimum)
+	return &testRecord{typ: 6, ttl: ttl, rdata: rdata, authority: true}
+}
+
+func TestResponseTTL(t *testing.T) {
+	// "example.com" A IN
+	query := []byte{0x12, 0x34, 0x01, 0x00, 0, 1, 0, 0, 0, 0, 0, 0,
+		7, 'e', 'x', 'a', 'm', 'p', 'l', 'e', 3, 'c', 'o', 'm', 0, 0, 1, 0, 1}
+
+	resp := testDNSResponse(query, 0,
+		&testRecord{typ: 1, ttl: 300, rdata: []byte{1, 2, 3, 4}},
+		&testRecord{typ: 1, ttl: 60, rdata: []byte{1, 2, 3, 5}},
+		testSOA(10, 10),
+	)
+	ttl, ok := responseTTL(resp)
+	require.True(t, ok)
+	require.Equal(t, 60*time.Second, ttl)
+
+	// negative TTL is min(SOA TTL, MINIMUM)
+	ttl, ok = responseTTL(testDNSResponse(query, 3, testSOA(3600, 30)))
+	require.True(t, ok)
+	require.Equal(t, 30*time.Second, ttl)
+	ttl, ok = responseTTL(testDNSResponse(query, 3, testSOA(20, 30)))
+	require.True(t, ok)
+	require.Equal(t, 20*time.Second, ttl)
+
+	_, ok = responseTTL(testDNSResponse(query, 3))
+	require.False(t, ok)
+	_, ok = responseTTL(resp[:len(resp)-1])
+	require.False(t, ok)
+	_, ok = responseTTL(query[:dnsHeaderSize+3])
+	require.False(t, ok)
+}
+
+func TestResolver_CacheTTL(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer func() { _ = conn.Close() }()
+	var queries int32
+	go func() {
+		buf := make([]byte, 65535)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			query := buf[:n]
+			names, err := questionNames(query)
+			if err != nil {
+				continue
+			}
+			atomic.AddInt32(&queries, 1)
+			qType := binary.BigEndian.Uint16(query[skipName(query, dnsHeaderSize):])
+			var resp []byte
+			switch {
+			case names[0] == "positive.test" && qType == 1:
+				resp = testDNSResponse(query, 0, &testRecord{typ: 1, ttl: 1, rdata: []byte{1, 2, 3, 4}})
+			case names[0] == "long.test" && qType == 1:
+				resp = testDNSResponse(query, 0, &testRecord{typ: 1, ttl: 3600, rdata: []byte{1, 2, 3, 4}})
+			case names[0] == "negative.test":
+				resp = testDNSResponse(query, 3, testSOA(60, 1))
+			case strings.HasSuffix(names[0], ".test") && strings.Count(names[0], ".") == 1:
+				// no AAAA record
+				resp = testDNSResponse(query, 0)
+			default:
+				resp = testDNSResponse(query, 3)
+			}
+			_, _ = conn.WriteTo(resp, addr)
+		}
+	}()
+	r, err := NewResolver(&ResolverOptions{
+		Servers:     []string{conn.LocalAddr().String()},
+		CacheTTL:    time.Minute,
+		NegativeTTL: time.Minute,
+	})
+	require.NoError(t, err)
+	ctx := context.Background()
+	expire := func(host string) time.Duration {
+		r.cacheRWM.RLock()
+		defer r.cacheRWM.RUnlock()
+		return time.Until(r.cache[host].expire)
+	}
+
+	// capped by the record TTL
+	ips, err := r.LookupIP(ctx, "positive.test")
+	require.NoError(t, err)
+	require.Len(t, ips, 1)
+	require.True(t, ips[0].Equal(net.IPv4(1, 2, 3, 4)))
+	require.True(t, expire("positive.test") <= time.Second)
+	_, err = r.LookupIP(ctx, "negative.test")
+	require.Error(t, err)
+	require.True(t, err.(*net.DNSError).IsNotFound)
+	require.True(t, expire("negative.test") <= time.Second)
+	// capped by CacheTTL
+	_, err = r.LookupIP(ctx, "long.test")
+	require.NoError(t, err)
+	require.True(t, expire("long.test") > 59*time.Second)
+	require.True(t, expire("long.test") <= time.Minute)
+
+	// cached
+	n := atomic.LoadInt32(&queries)
+	_, err = r.LookupIP(ctx, "positive.test")
+	require.NoError(t, err)
+	_, err = r.LookupIP(ctx, "negative.test")
+	require.Error(t, err)
+	require.Equal(t, n, atomic.LoadInt32(&queries))
+
+	// expired
+	time.Sleep(1100 * time.Millisecond)
+	_, err = r.LookupIP(ctx, "positive.test")
+	require.NoError(t, err)
+	n2 := atomic.LoadInt32(&queries)
+	require.True(t, n2 > n)
+	_, err = r.LookupIP(ctx, "negative.test")
+	require.Error(t, err)
+	require.True(t, atomic.LoadInt32(&queries) > n2)
+	_, err = r.LookupIP(ctx, "long.test")
+	require.NoError(t, err)
+}
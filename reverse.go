@@ -0,0 +1,196 @@
+package socks
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// reverse tunnel
+//
+// after authentication, client send typeReverse with the port instead of
+// the host data, server listen on the port if the user is allowed, then
+// reply respOK with the bound port. For each accepted connection, server
+// open a new stream in the same session, send the address about the
+// origin(type + host + port) and relay it. The client close the session
+// to stop listening, so the transport must support multiple streams.
+//
+// +-------+--------+
+// | type  |  port  |
+// +-------+--------+
+// | uint8 | uint16 |
+// +-------+--------+
+
+var errSingleStream = errors.New("the transport doesn't support reverse tunnels")
+
+// isMultiStream is used to check the session can carry multiple streams.
+func isMultiStream(session Session) bool {
+	_, ok := session.(*singleStreamSession)
+	return !ok
+}
+
+// ListenReverse is used to let the server listen on the port with an
+// authenticated conn, like "ssh -R", the connections accepted by the
+// server are returned by Accept of the listener, port 0 means a random
+// port, close the listener will close conn and stop the server listening.
+func ListenReverse(conn net.Conn, port uint16) (net.Listener, error) {
+	c, ok := conn.(*Conn)
+	if !ok || !isMultiStream(c.session) {
+		_ = conn.Close()
+		return nil, errSingleStream
+	}
+	req := make([]byte, typeSize+portSize)
+	req[0] = typeReverse
+	binary.BigEndian.PutUint16(req[typeSize:], port)
+	_, err := conn.Write(req)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	resp := make([]byte, respSize)
+	_, err = io.ReadFull(conn, resp)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	if resp[0] != respOK {
+		_ = conn.Close()
+		return nil, Response(resp[0])
+	}
+	bound := make([]byte, portSize)
+	_, err = io.ReadFull(conn, bound)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	_ = conn.SetDeadline(time.Time{})
+	addr, err := AddrFromNetAddr(c.RemoteAddr())
+	if err != nil {
+		addr = &Addr{IP: net.IPv4zero}
+	}
+	addr.Port = binary.BigEndian.Uint16(bound)
+	return &reverseListener{conn: c, addr: addr}, nil
+}
+
+type reverseListener struct {
+	conn *Conn
+	addr *Addr
+}
+
+// Accept is used to accept the stream opened by the server,
+// the remote address about the conn is the origin address.
+func (l *reverseListener) Accept() (net.Conn, error) {
+	for {
+		stream, err := l.conn.session.AcceptStream()
+		if err != nil {
+			return nil, err
+		}
+		_ = stream.SetReadDeadline(time.Now().Add(30 * time.Second))
+		origin, err := unpackAddr(stream)
+		if err != nil {
+			_ = stream.Close()
+			continue
+		}
+		_ = stream.SetReadDeadline(time.Time{})
+		return &reverseConn{Stream: stream, origin: origin}, nil
+	}
+}
+
+func (l *reverseListener) Close() error {
+	return l.conn.Close()
+}
+
+// Addr is used to get the address that the server is listening on.
+func (l *reverseListener) Addr() net.Addr {
+	return l.addr
+}
+
+type reverseConn struct {
+	Stream
+	origin *Addr
+}
+
+func (c *reverseConn) RemoteAddr() net.Addr {
+	return c.origin
+}
+
+// SetReverseHost is used to set the host about the reverse tunnel
+// listeners, default is all interfaces, it must be called before
+// ListenAndServe.
+func (s *Server) SetReverseHost(host string) {
+	s.reverseHost = host
+}
+
+// serveReverse is called after the type is read, it returns
+// after the client closed the stream or the session.
+func (s *Server) serveReverse(conn net.Conn, session Session, u *user, sess *session,
+	writeResp func(resp uint8, extra ...byte) error) {
+	portData := make([]byte, portSize)
+	_, err := io.ReadFull(conn, portData)
+	if err != nil {
+		return
+	}
+	port := binary.BigEndian.Uint16(portData)
+	sess.setTarget(fmt.Sprintf("reverse :%d", port))
+	if session == nil || !isMultiStream(session) || !u.allowReverse(port) {
+		_ = writeResp(respNotAllowed)
+		return
+	}
+	address := net.JoinHostPort(s.reverseHost, strconv.Itoa(int(port)))
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		_ = writeResp(respListenFailed)
+		return
+	}
+	defer func() { _ = listener.Close() }()
+	bound := listener.Addr().(*net.TCPAddr).Port
+	sess.setTarget(fmt.Sprintf("reverse :%d", bound))
+	binary.BigEndian.PutUint16(portData, uint16(bound))
+	err = writeResp(respOK, portData...)
+	if err != nil {
+		return
+	}
+	// stop listening after the client closed the stream or the session
+	go func() {
+		_, _ = io.Copy(ioutil.Discard, conn)
+		_ = listener.Close()
+	}()
+	for {
+		remote, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.handleReverse(session, remote, sess)
+	}
+}
+
+func (s *Server) handleReverse(session Session, remote net.Conn, sess *session) {
+	defer func() { _ = remote.Close() }()
+	origin, err := AddrFromNetAddr(remote.RemoteAddr())
+	if err != nil {
+		return
+	}
+	header, err := packAddr(origin)
+	if err != nil {
+		return
+	}
+	stream, err := session.OpenStream()
+	if err != nil {
+		return
+	}
+	defer func() { _ = stream.Close() }()
+	_, err = stream.Write(header)
+	if err != nil {
+		return
+	}
+	relayOpts := s.relayOpts
+	relayOpts.Upload = &sess.upload
+	relayOpts.Download = &sess.download
+	Relay(stream, remote, &relayOpts)
+}
@@ -0,0 +1,84 @@
+package socks
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestListenReverse(t *testing.T) {
+	server, client := testServer(t)
+	defer server.Close()
+
+	t.Run("not allowed", func(t *testing.T) {
+		conn, err := client.Dial()
+		require.NoError(t, err)
+		_, err = ListenReverse(conn, 0)
+		require.Equal(t, ErrNotAllowed, err)
+	})
+
+	err := server.SetUser(DefaultUser, &User{Password: "test", ReversePorts: []uint16{0}})
+	require.NoError(t, err)
+
+	t.Run("echo", func(t *testing.T) {
+		conn, err := client.Dial()
+		require.NoError(t, err)
+		listener, err := ListenReverse(conn, 0)
+		require.NoError(t, err)
+		port := listener.Addr().(*Addr).Port
+		require.NotZero(t, port)
+		origins := make(chan net.Addr, 2)
+		go func() {
+			for {
+				conn, err := listener.Accept()
+				if err != nil {
+					return
+				}
+				origins <- conn.RemoteAddr()
+				go func() {
+					defer func() { _ = conn.Close() }()
+					testEcho(conn)
+				}()
+			}
+		}()
+
+		// multiple connections are carried by the streams of one session
+		address := fmt.Sprintf("127.0.0.1:%d", port)
+		for i := 0; i < 2; i++ {
+			public, err := net.Dial("tcp", address)
+			require.NoError(t, err)
+			defer func() { _ = public.Close() }()
+			_, err = public.Write([]byte("hello"))
+			require.NoError(t, err)
+			buf := make([]byte, 5)
+			_ = public.SetReadDeadline(time.Now().Add(10 * time.Second))
+			_, err = io.ReadFull(public, buf)
+			require.NoError(t, err)
+			require.Equal(t, "hello", string(buf))
+			require.Equal(t, public.LocalAddr().String(), (<-origins).String())
+		}
+
+		// the server stops listening after the listener is closed
+		require.NoError(t, listener.Close())
+		require.Eventually(t, func() bool {
+			conn, err := net.Dial("tcp", address)
+			if err != nil {
+				return true
+			}
+			_ = conn.Close()
+			return false
+		}, 10*time.Second, 50*time.Millisecond)
+	})
+
+	t.Run("single stream", func(t *testing.T) {
+		client.SetTCPFallback(&TCPFallbackOptions{Address: server.TCPAddr().String()})
+		conn, err := dialConn(client.fallback.transport, client.fallback.address, client.tlsConfig)
+		require.NoError(t, err)
+		_, err = ListenReverse(conn, 0)
+		require.Equal(t, errSingleStream, err)
+	})
+}
@@ -1,124 +1,346 @@
 package socks
 
 import (
+	"bytes"
 	"crypto/sha256"
 	"crypto/subtle"
 	"crypto/tls"
 	"io"
 	"net"
+	"net/http"
 	"os"
+	"sync"
 	"time"
-
-	"github.com/lucas-clemente/quic-go"
-	"github.com/pkg/errors"
 )
 
+// closeTimeout is the maximum time about wait the client
+// close the session after the relay is finished.
+const closeTimeout = 10 * time.Second
+
 type Server struct {
-	hash     []byte // password hash
-	listener *listener
+	listener  SessionListener
+	listeners []SessionListener // the other transports
+	tcpAddr   net.Addr
+	tlsConfig *tls.Config
+	dialer    *dialer
+
+	users    map[string]*user
+	usersRWM sync.RWMutex
+
+	sessionID   uint64
+	sessions    map[uint64]*session
+	sessionsRWM sync.RWMutex
+
+	admin       *http.Server
+	adminClosed bool // Close is called
+	adminRWM    sync.RWMutex
+
+	relayOpts   RelayOptions
+	fallback    func(conn net.Conn)
+	reverseHost string
 }
 
 func NewServer(address string, password []byte, tlsConfig *tls.Config) (*Server, error) {
+	return NewServerWithTransport(NewQUICTransport(), address, password, tlsConfig)
+}
+
+// NewServerWithTransport is like NewServer, the sessions
+// from clients are accepted by the transport.
+func NewServerWithTransport(transport Transport, address string, password []byte,
+	tlsConfig *tls.Config) (*Server, error) {
 	// skip QUIC debug log about BBR
 	err := os.Setenv("GODEBUG", "bbr=1")
 	if err != nil {
 		return nil, err
 	}
 	tlsConfig.NextProtos = append(tlsConfig.NextProtos, nextProto)
-	addr, err := net.ResolveUDPAddr("udp", address)
+	listener, err := transport.Listen(address, tlsConfig)
 	if err != nil {
 		return nil, err
 	}
-	conn, err := net.ListenUDP("udp", addr)
+	dialer, _ := newDialer(nil)
+	server := Server{
+		listener:  listener,
+		tlsConfig: tlsConfig,
+		dialer:    dialer,
+		users:     make(map[string]*user),
+		sessions:  make(map[uint64]*session),
+	}
+	err = server.SetUser(DefaultUser, &User{Password: string(password)})
 	if err != nil {
+		_ = listener.Close()
 		return nil, err
 	}
-	quicCfg := quic.Config{
-		HandshakeTimeout: 30 * time.Second,
-		IdleTimeout:      10 * time.Minute,
-		KeepAlive:        true,
-	}
-	quicListener, err := quic.Listen(conn, tlsConfig, &quicCfg)
+	return &server, nil
+}
+
+// SetDialOptions is used to set options about outbound
+// connections, it must be called before ListenAndServe.
+func (s *Server) SetDialOptions(opts *DialOptions) error {
+	dialer, err := newDialer(opts)
 	if err != nil {
-		return nil, errors.WithStack(err)
+		return err
+	}
+	s.dialer = dialer
+	return nil
+}
+
+// SetRelayOptions is used to set the idle timeout and the buffer size
+// about relay, the counters are ignored, it must be called before
+// ListenAndServe.
+func (s *Server) SetRelayOptions(opts *RelayOptions) {
+	s.relayOpts = RelayOptions{
+		IdleTimeout: opts.IdleTimeout,
+		BufferSize:  opts.BufferSize,
 	}
-	listener := listener{
-		rawConn:  conn,
-		Listener: quicListener,
-		timeout:  30 * time.Second,
+}
+
+// SetFallback is used to set the handler about the sessions that failed
+// to authenticate, include the streams that are not opened by the client
+// like HTTP/3 requests, the conn replays the data that have been read and
+// the deadline is one minute after the session is accepted. By default,
+// the session is closed, it must be called before ListenAndServe.
+func (s *Server) SetFallback(handler func(conn net.Conn)) {
+	s.fallback = handler
+}
+
+// Addr is used to get the listener address, it is useful
+// when the server is listening on an ephemeral port.
+func (s *Server) Addr() net.Addr {
+	return s.listener.Addr()
+}
+
+// Listen is used to also accept the sessions from the transport, it
+// returns the listener address, it must be called before ListenAndServe.
+func (s *Server) Listen(transport Transport, address string) (net.Addr, error) {
+	listener, err := transport.Listen(address, s.tlsConfig)
+	if err != nil {
+		return nil, err
 	}
-	hash := sha256.Sum256(password)
-	return &Server{
-		hash:     hash[:],
-		listener: &listener,
-	}, nil
+	s.listeners = append(s.listeners, listener)
+	return listener.Addr(), nil
 }
 
 func (s *Server) ListenAndServe() error {
+	for _, listener := range s.listeners {
+		go func(listener SessionListener) { _ = s.serve(listener) }(listener)
+	}
+	return s.serve(s.listener)
+}
+
+func (s *Server) serve(listener SessionListener) error {
 	for {
-		conn, err := s.listener.Accept()
+		session, err := listener.Accept()
 		if err != nil {
 			return err
 		}
-		go s.handleConn(conn)
+		go s.handleSession(session)
 	}
 }
 
+// handleSession is used to accept the stream about the session, the
+// session will be closed if the stream is not opened in a minute.
+func (s *Server) handleSession(session Session) {
+	timer := time.AfterFunc(time.Minute, func() { _ = session.Close() })
+	stream, err := session.AcceptStream()
+	timer.Stop()
+	if err != nil {
+		_ = session.Close()
+		return
+	}
+	s.handleConn(&Conn{session: session, stream: stream})
+}
+
 func (s *Server) handleConn(conn net.Conn) {
+	// if the server has sent the response, wait the client close the
+	// session, otherwise the response may be dropped by the session close
+	sConn, _ := conn.(*Conn)
+	var graceful bool
 	defer func() {
 		recover()
+		if graceful && sConn != nil {
+			_ = sConn.CloseWrite()
+			sConn.waitClose(closeTimeout)
+		}
 		_ = conn.Close()
-
 	}()
+	sess := s.addSession(conn)
+	defer s.deleteSession(sess)
 	_ = conn.SetDeadline(time.Now().Add(time.Minute))
+	// the stream is not opened by the client, such as an HTTP/3 request
+	if sConn != nil && isForeign(sConn.stream) {
+		graceful = s.handleFallback(conn, nil)
+		return
+	}
 	// read password hash with random data
 	tempHash := make([]byte, sha256.Size)
-	_, err := io.ReadFull(conn, tempHash)
+	n, err := io.ReadFull(conn, tempHash)
 	if err != nil {
+		graceful = s.handleFallback(conn, tempHash[:n])
 		return
 	}
+	// read the padding, the first byte is the padding size minus 128,
+	// the pipelined request may send the connect request with it
+	received := append([]byte(nil), tempHash...) // for fallback
 	buf := make([]byte, 256)
-	limitedReader := io.LimitReader(conn, 256)
-	hash := sha256.New()
-	hash.Write(s.hash)
-	for {
-		n, err := limitedReader.Read(buf)
-		if err != nil {
+	paddingSize := -1
+	for paddingSize == -1 || len(received) < sha256.Size+paddingSize {
+		n, err := conn.Read(buf)
+		received = append(received, buf[:n]...)
+		if paddingSize == -1 && len(received) > sha256.Size {
+			if received[sha256.Size] >= 128 {
+				graceful = s.handleFallback(conn, received)
+				return
+			}
+			paddingSize = minPaddingSize + int(received[sha256.Size])
+		}
+		if err != nil && (paddingSize == -1 || len(received) < sha256.Size+paddingSize) {
+			graceful = s.handleFallback(conn, received)
 			return
 		}
-		hash.Write(buf[:n])
-		if subtle.ConstantTimeCompare(hash.Sum(nil), tempHash) == 1 {
+	}
+	padding := received[sha256.Size : sha256.Size+paddingSize]
+	leftover := received[sha256.Size+paddingSize:]
+	// check the hash once for each user
+	var u *user
+	for _, candidate := range s.userList() {
+		h := sha256.New()
+		h.Write(candidate.hash)
+		h.Write(padding)
+		if subtle.ConstantTimeCompare(h.Sum(nil), tempHash) == 1 {
+			u = candidate
 			break
 		}
 	}
-	_, err = conn.Write([]byte{authOK})
-	if err != nil {
+	if u == nil {
+		graceful = s.handleFallback(conn, received)
 		return
 	}
+	sess.setUser(u.name)
+	if len(leftover) > 0 {
+		conn = &bufferedConn{
+			Conn: conn,
+			r:    io.MultiReader(bytes.NewReader(leftover), conn),
+		}
+	}
+	// if the request is pipelined, send the auth response
+	// with the connect response together
+	var authResp []byte
+	if len(leftover) == 0 {
+		_, err = conn.Write([]byte{authOK})
+		if err != nil {
+			return
+		}
+	} else {
+		authResp = []byte{authOK}
+	}
+	writeResp := func(resp uint8, extra ...byte) error {
+		_, err := conn.Write(append(append(authResp, resp), extra...))
+		authResp = nil
+		graceful = err == nil
+		return err
+	}
 
 	_ = conn.SetDeadline(time.Time{})
-	// get connect host
-	host, err := unpackHostData(conn)
+	typ := make([]byte, typeSize)
+	_, err = io.ReadFull(conn, typ)
 	if err != nil {
-		_, _ = conn.Write([]byte{respInvalidHost})
 		return
 	}
-	remote, err := net.Dial("tcp", host)
+	// the client wants the bound address
+	bound := typ[0]&typeBound != 0
+	typ[0] &^= typeBound
+	switch typ[0] {
+	case typeDNS:
+		if writeResp(respOK) == nil {
+			s.serveDNS(conn, u, sess)
+		}
+		return
+	case typeReverse:
+		var session Session
+		if sConn != nil {
+			session = sConn.session
+		}
+		s.serveReverse(conn, session, u, sess, writeResp)
+		return
+	}
+	// get connect host
+	addr, err := unpackHostData(io.MultiReader(bytes.NewReader(typ), conn))
+	switch err {
+	case nil:
+	case ErrInvalidType, ErrInvalidFQDN, ErrInvalidPort:
+		_ = writeResp(respInvalidHost)
+		return
+	default: // failed to read
+		return
+	}
+	sess.setTarget(addr.String())
+	remote, err := s.dialer.Dial(addr.String(), u.acl)
 	if err != nil {
-		_, _ = conn.Write([]byte{respConnectFailed})
+		_ = writeResp(dialResponse(err))
 		return
 	}
 	defer func() { _ = remote.Close() }()
-	_, _ = conn.Write([]byte{respOK})
+	var boundData []byte
+	if bound {
+		boundData = packBoundAddr(remote.LocalAddr())
+	}
+	err = writeResp(respOK, boundData...)
+	if err != nil {
+		return
+	}
 
-	// copy
-	go func() {
-		defer func() { recover() }()
-		_, _ = io.Copy(conn, remote)
-	}()
-	_, _ = io.Copy(remote, conn)
+	relayOpts := s.relayOpts
+	relayOpts.Upload = &sess.upload
+	relayOpts.Download = &sess.download
+	result := Relay(conn, remote, &relayOpts)
+	graceful = result.Reason == CloseEOF
+}
+
+// packBoundAddr is used to pack the local address about the target
+// connection, if it is not an IP address, it will be 0.0.0.0:0.
+func packBoundAddr(local net.Addr) []byte {
+	addr, err := AddrFromNetAddr(local)
+	if err != nil || addr.IP == nil {
+		addr = &Addr{IP: net.IPv4zero}
+	}
+	data, err := packAddr(addr)
+	if err != nil {
+		data, _ = packAddr(&Addr{IP: net.IPv4zero})
+	}
+	return data
+}
+
+// isForeign is used to check the stream is not opened by the client.
+func isForeign(stream Stream) bool {
+	f, ok := stream.(interface{ foreign() bool })
+	return ok && f.foreign()
+}
+
+// handleFallback is used to handle the session that failed to
+// authenticate, it returns true if the fallback handler is called,
+// by default, the session is closed.
+func (s *Server) handleFallback(conn net.Conn, received []byte) bool {
+	if s.fallback == nil {
+		return false
+	}
+	conn = &bufferedConn{
+		Conn: conn,
+		r:    io.MultiReader(bytes.NewReader(received), conn),
+	}
+	s.fallback(conn)
+	return true
 }
 
 func (s *Server) Close() {
 	_ = s.listener.Close()
+	for _, listener := range s.listeners {
+		_ = listener.Close()
+	}
+	s.adminRWM.Lock()
+	defer s.adminRWM.Unlock()
+	s.adminClosed = true
+	if s.admin != nil {
+		_ = s.admin.Close()
+	}
 }
@@ -8,6 +8,9 @@ import (
 	"log"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/For-ACGN/quic-socks"
 )
@@ -15,14 +18,50 @@ import (
 func main() {
 	var (
 		localAddr string
+		tcpAddr   string
+		wsAddr    string
+		wsOpts    socks.WebSocketOptions
 		password  string
 		certPath  string
 		keyPath   string
+		adminAddr string
+		dialOpts  socks.DialOptions
+		ipMode    string
+		dnsOpts   socks.ResolverOptions
+		dnsList   string
+		hostsPath string
+		routes    routeFlag
+		relayOpts socks.RelayOptions
+		reverse   string
+		revHost   string
 	)
 	flag.StringVar(&localAddr, "l", ":1523", "bind address")
+	flag.StringVar(&tcpAddr, "tcp", "", "TLS over TCP bind address for the clients that UDP is blocked")
+	flag.StringVar(&wsAddr, "ws", "", "WebSocket bind address for the clients behind HTTP reverse proxy or CDN")
+	flag.StringVar(&wsOpts.Path, "ws-path", "/", "WebSocket HTTP path")
+	flag.BoolVar(&wsOpts.Plain, "ws-plain", false, "WebSocket without TLS, the reverse proxy terminates TLS")
 	flag.StringVar(&password, "p", "123456", "password")
 	flag.StringVar(&certPath, "c", "cert.pem", "tls certificate file path")
 	flag.StringVar(&keyPath, "k", "key.pem", "tls key file path")
+	flag.StringVar(&adminAddr, "admin", "", "admin API address(localhost:port or unix:path)")
+	flag.StringVar(&dialOpts.LocalAddr, "bind", "", "source IP address about outbound connections")
+	flag.StringVar(&dialOpts.Interface, "iface", "", "network interface about outbound connections(Linux)")
+	flag.StringVar(&ipMode, "ip", "", "ip mode: ipv4, ipv6, prefer-ipv4 or prefer-ipv6")
+	flag.DurationVar(&dialOpts.Timeout, "dial-timeout", 30*time.Second, "outbound dial timeout")
+	flag.DurationVar(&dialOpts.KeepAlive, "keepalive", 0, "TCP keep-alive period, negative to disable")
+	flag.DurationVar(&dialOpts.FallbackDelay, "fallback-delay", 0,
+		"Happy Eyeballs fallback delay, negative to disable")
+	flag.StringVar(&dnsList, "dns", "", "DNS servers split by \",\" like tls://1.1.1.1,https://1.1.1.1/dns-query")
+	flag.StringVar(&hostsPath, "hosts", "", "hosts file path that override DNS results")
+	flag.DurationVar(&dnsOpts.CacheTTL, "dns-ttl", 5*time.Minute, "the maximum DNS positive cache TTL, capped by the record TTL")
+	flag.DurationVar(&dnsOpts.NegativeTTL, "dns-neg-ttl", 30*time.Second, "the maximum DNS negative cache TTL, capped by the SOA record TTL")
+	flag.Var(&routes, "route", "upstream proxy route like \"*.example.com,10.0.0.0/8=socks5://host:port\""+
+		", \"*\" means all targets, can be set multiple times")
+	flag.DurationVar(&relayOpts.IdleTimeout, "idle", 5*time.Minute, "relay idle timeout, negative to disable")
+	flag.IntVar(&relayOpts.BufferSize, "buffer", 32*1024, "relay buffer size per direction")
+	flag.StringVar(&reverse, "reverse", "", "the ports that the clients can listen for the reverse tunnels"+
+		" split by \",\", 0 allows any port")
+	flag.StringVar(&revHost, "reverse-host", "", "the host about the reverse tunnel listeners, default is all")
 	flag.Parse()
 
 	// set certificate
@@ -37,8 +76,76 @@ func main() {
 		fmt.Print(err)
 		return
 	}
+	if reverse != "" {
+		user := socks.User{Password: password}
+		for _, p := range strings.Split(reverse, ",") {
+			port, err := strconv.ParseUint(strings.TrimSpace(p), 10, 16)
+			if err != nil {
+				fmt.Print("invalid reverse port: ", err)
+				return
+			}
+			user.ReversePorts = append(user.ReversePorts, uint16(port))
+		}
+		err = server.SetUser(socks.DefaultUser, &user)
+		if err != nil {
+			fmt.Print(err)
+			return
+		}
+		server.SetReverseHost(revHost)
+	}
+	if tcpAddr != "" {
+		err = server.ListenTCP(tcpAddr)
+		if err != nil {
+			fmt.Print(err)
+			return
+		}
+	}
+	if wsAddr != "" {
+		_, err = server.Listen(socks.NewWebSocketTransport(&wsOpts), wsAddr)
+		if err != nil {
+			fmt.Print(err)
+			return
+		}
+	}
+	dialOpts.IPMode, err = socks.ParseIPMode(ipMode)
+	if err != nil {
+		fmt.Print(err)
+		return
+	}
+	if dnsList != "" {
+		dnsOpts.Servers = strings.Split(dnsList, ",")
+	}
+	if hostsPath != "" {
+		dnsOpts.Hosts, err = loadHosts(hostsPath)
+		if err != nil {
+			fmt.Print(err)
+			return
+		}
+	}
+	dialOpts.Resolver, err = socks.NewResolver(&dnsOpts)
+	if err != nil {
+		fmt.Print(err)
+		return
+	}
+	dialOpts.Routes = routes
+	err = server.SetDialOptions(&dialOpts)
+	if err != nil {
+		fmt.Print(err)
+		return
+	}
+	server.SetRelayOptions(&relayOpts)
 	log.SetOutput(ioutil.Discard)
 
+	// start admin API
+	if adminAddr != "" {
+		go func() {
+			err := server.ListenAndServeAdmin(adminAddr)
+			if err != nil {
+				fmt.Print(err)
+			}
+		}()
+	}
+
 	// handle signal
 	go func() {
 		signalChan := make(chan os.Signal, 1)
@@ -52,3 +159,45 @@ func main() {
 		fmt.Print(err)
 	}
 }
+
+// loadHosts is used to load hosts file like /etc/hosts.
+func loadHosts(path string) (map[string][]string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	hosts := make(map[string][]string)
+	for _, line := range strings.Split(string(data), "\n") {
+		if i := strings.Index(line, "#"); i != -1 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		for _, name := range fields[1:] {
+			hosts[name] = append(hosts[name], fields[0])
+		}
+	}
+	return hosts, nil
+}
+
+// routeFlag is used to set multiple upstream proxy routes.
+type routeFlag []*socks.Route
+
+func (r *routeFlag) String() string {
+	return fmt.Sprint(len(*r), " routes")
+}
+
+func (r *routeFlag) Set(value string) error {
+	i := strings.Index(value, "=")
+	if i == -1 {
+		return fmt.Errorf("invalid route \"%s\"", value)
+	}
+	route := socks.Route{Proxy: value[i+1:]}
+	if hosts := value[:i]; hosts != "*" {
+		route.Hosts = strings.Split(hosts, ",")
+	}
+	*r = append(*r, &route)
+	return nil
+}
@@ -0,0 +1,229 @@
+package socks
+
+import (
+	"crypto/sha256"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// DefaultUser is the name of the user created by NewServer.
+const DefaultUser = "default"
+
+// User contains the password and the access control list of a user,
+// ReversePorts are the ports that the user can listen for the reverse
+// tunnels, 0 allows any port.
+type User struct {
+	Password     string   `json:"password"`
+	ACL          *ACL     `json:"acl,omitempty"`
+	ReversePorts []uint16 `json:"reverse_ports,omitempty"`
+}
+
+// UserInfo is the information about a user without password.
+type UserInfo struct {
+	Name         string   `json:"name"`
+	ACL          *ACL     `json:"acl,omitempty"`
+	ReversePorts []uint16 `json:"reverse_ports,omitempty"`
+}
+
+type user struct {
+	name         string
+	hash         []byte // password hash
+	acl          *acl
+	raw          *ACL
+	reversePorts []uint16
+}
+
+// allowReverse is used to check the user can listen on the port.
+func (u *user) allowReverse(port uint16) bool {
+	for _, p := range u.reversePorts {
+		if p == 0 || p == port {
+			return true
+		}
+	}
+	return false
+}
+
+// allowResolve is used to check the names in the DNS query are allowed
+// by the ACL, the query is not parsed if the user has no ACL.
+func (u *user) allowResolve(query []byte) bool {
+	if u.acl == nil {
+		return true
+	}
+	names, err := questionNames(query)
+	if err != nil {
+		return false
+	}
+	for _, name := range names {
+		if !u.acl.resolvable(name) {
+			return false
+		}
+	}
+	return true
+}
+
+// SessionInfo is the information about an active session.
+type SessionInfo struct {
+	ID         uint64    `json:"id"`
+	RemoteAddr string    `json:"remote_addr"`
+	User       string    `json:"user"`
+	Target     string    `json:"target"`
+	Upload     uint64    `json:"upload"`
+	Download   uint64    `json:"download"`
+	Created    time.Time `json:"created"`
+	Age        string    `json:"age"`
+}
+
+type session struct {
+	// must at the top of the struct for 64-bit alignment
+	upload   uint64
+	download uint64
+
+	id      uint64
+	conn    net.Conn
+	created time.Time
+
+	user   string
+	target string
+	rwm    sync.RWMutex
+}
+
+func (s *session) setUser(user string) {
+	s.rwm.Lock()
+	defer s.rwm.Unlock()
+	s.user = user
+}
+
+func (s *session) setTarget(target string) {
+	s.rwm.Lock()
+	defer s.rwm.Unlock()
+	s.target = target
+}
+
+func (s *session) info() *SessionInfo {
+	s.rwm.RLock()
+	defer s.rwm.RUnlock()
+	return &SessionInfo{
+		ID:         s.id,
+		RemoteAddr: s.conn.RemoteAddr().String(),
+		User:       s.user,
+		Target:     s.target,
+		Upload:     atomic.LoadUint64(&s.upload),
+		Download:   atomic.LoadUint64(&s.download),
+		Created:    s.created,
+		Age:        time.Since(s.created).Truncate(time.Second).String(),
+	}
+}
+
+// SetUser is used to add or update a user at runtime,
+// it will not affect the established sessions.
+func (s *Server) SetUser(name string, u *User) error {
+	if name == "" {
+		return errors.New("empty user name")
+	}
+	if u == nil || u.Password == "" {
+		return errors.New("empty password")
+	}
+	a, err := u.ACL.compile()
+	if err != nil {
+		return err
+	}
+	hash := sha256.Sum256([]byte(u.Password))
+	s.usersRWM.Lock()
+	defer s.usersRWM.Unlock()
+	s.users[name] = &user{
+		name:         name,
+		hash:         hash[:],
+		acl:          a,
+		raw:          u.ACL,
+		reversePorts: append([]uint16(nil), u.ReversePorts...),
+	}
+	return nil
+}
+
+// DeleteUser is used to delete a user at runtime.
+func (s *Server) DeleteUser(name string) error {
+	s.usersRWM.Lock()
+	defer s.usersRWM.Unlock()
+	if _, ok := s.users[name]; !ok {
+		return errors.Errorf("user \"%s\" is not exist", name)
+	}
+	delete(s.users, name)
+	return nil
+}
+
+// Users is used to get all users, the result is sorted by name.
+func (s *Server) Users() []*UserInfo {
+	s.usersRWM.RLock()
+	defer s.usersRWM.RUnlock()
+	users := make([]*UserInfo, 0, len(s.users))
+	for _, u := range s.users {
+		users = append(users, &UserInfo{
+			Name:         u.name,
+			ACL:          u.raw,
+			ReversePorts: u.reversePorts,
+		})
+	}
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].Name < users[j].Name
+	})
+	return users
+}
+
+func (s *Server) userList() []*user {
+	s.usersRWM.RLock()
+	defer s.usersRWM.RUnlock()
+	users := make([]*user, 0, len(s.users))
+	for _, u := range s.users {
+		users = append(users, u)
+	}
+	return users
+}
+
+func (s *Server) addSession(conn net.Conn) *session {
+	sess := session{
+		conn:    conn,
+		created: time.Now(),
+	}
+	s.sessionsRWM.Lock()
+	defer s.sessionsRWM.Unlock()
+	s.sessionID++
+	sess.id = s.sessionID
+	s.sessions[sess.id] = &sess
+	return &sess
+}
+
+func (s *Server) deleteSession(sess *session) {
+	s.sessionsRWM.Lock()
+	defer s.sessionsRWM.Unlock()
+	delete(s.sessions, sess.id)
+}
+
+// Sessions is used to get all active sessions, the result is sorted by id.
+func (s *Server) Sessions() []*SessionInfo {
+	s.sessionsRWM.RLock()
+	defer s.sessionsRWM.RUnlock()
+	sessions := make([]*SessionInfo, 0, len(s.sessions))
+	for _, sess := range s.sessions {
+		sessions = append(sessions, sess.info())
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].ID < sessions[j].ID
+	})
+	return sessions
+}
+
+// CloseSession is used to terminate an active session.
+func (s *Server) CloseSession(id uint64) error {
+	s.sessionsRWM.RLock()
+	sess, ok := s.sessions[id]
+	s.sessionsRWM.RUnlock()
+	if !ok {
+		return errors.Errorf("session %d is not exist", id)
+	}
+	return sess.conn.Close()
+}
@@ -0,0 +1,53 @@
+package socks
+
+import (
+	"crypto/tls"
+	"net"
+)
+
+// Transport is used to create the sessions between client and server,
+// the auth and host data protocol is carried by the streams of session.
+// The default transport is QUIC, see NewQUICTransport and NewTCPTransport.
+type Transport interface {
+	// Dial is used to dial the server, the session is
+	// authenticated by TLS before the password
+	Dial(address string, tlsConfig *tls.Config) (Session, error)
+
+	// Listen is used to listen on the address for accept sessions
+	Listen(address string, tlsConfig *tls.Config) (SessionListener, error)
+}
+
+// Session is a connection between client and server that carries streams.
+type Session interface {
+	// OpenStream is used to open a stream, the peer
+	// will accept it with AcceptStream
+	OpenStream() (Stream, error)
+
+	// AcceptStream is used to accept a stream opened by the peer
+	AcceptStream() (Stream, error)
+
+	// Done is closed after the session is closed by either side, if
+	// the session only supports one stream, it is also closed after
+	// the peer closed the stream
+	Done() <-chan struct{}
+
+	LocalAddr() net.Addr
+	RemoteAddr() net.Addr
+	Close() error
+}
+
+// Stream is a bidirectional stream in Session.
+type Stream interface {
+	net.Conn
+
+	// CloseWrite is used to close the write side, the peer
+	// will read io.EOF after all data are read, like TCP FIN
+	CloseWrite() error
+}
+
+// SessionListener is used to accept the sessions from clients.
+type SessionListener interface {
+	Accept() (Session, error)
+	Addr() net.Addr
+	Close() error
+}
@@ -0,0 +1,224 @@
+package socks
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/lucas-clemente/quic-go"
+	"github.com/pkg/errors"
+)
+
+type quicTransport struct {
+	handshakeTimeout time.Duration
+
+	// dialer provides the local address and the control function
+	// about the UDP socket, it can be nil
+	dialer *net.Dialer
+}
+
+// NewQUICTransport is used to create the QUIC transport,
+// it is the default transport about Client and Server.
+func NewQUICTransport() Transport {
+	return &quicTransport{handshakeTimeout: 30 * time.Second}
+}
+
+func (t *quicTransport) config() *quic.Config {
+	return &quic.Config{
+		HandshakeTimeout: t.handshakeTimeout,
+		IdleTimeout:      10 * time.Minute,
+		KeepAlive:        true,
+	}
+}
+
+func (t *quicTransport) Dial(address string, tlsConfig *tls.Config) (Session, error) {
+	network, local := "udp", ":0"
+	lc := net.ListenConfig{}
+	if t.dialer != nil {
+		// the server must have the same IP version with the local address
+		if lAddr, ok := t.dialer.LocalAddr.(*net.TCPAddr); ok {
+			network = "udp6"
+			if lAddr.IP.To4() != nil {
+				network = "udp4"
+			}
+			local = net.JoinHostPort(lAddr.IP.String(), "0")
+		}
+		lc.Control = t.dialer.Control
+	}
+	rAddr, err := net.ResolveUDPAddr(network, address)
+	if err != nil {
+		return nil, err
+	}
+	udpConn, err := lc.ListenPacket(context.Background(), network, local)
+	if err != nil {
+		return nil, err
+	}
+	session, err := quic.Dial(udpConn, rAddr, address, tlsConfig, t.config())
+	if err != nil {
+		_ = udpConn.Close()
+		return nil, err
+	}
+	return &quicSession{rawConn: udpConn, Session: session}, nil
+}
+
+func (t *quicTransport) Listen(address string, tlsConfig *tls.Config) (SessionListener, error) {
+	addr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	listener, err := quic.Listen(conn, tlsConfig, t.config())
+	if err != nil {
+		_ = conn.Close()
+		return nil, errors.WithStack(err)
+	}
+	return &quicListener{rawConn: conn, Listener: listener}, nil
+}
+
+type quicSession struct {
+	// must close rawConn manually to prevent goroutine leak
+	// in package github.com/lucas-clemente/quic-go
+	// go m.listen() in newPacketHandlerMap()
+	rawConn net.PacketConn
+	quic.Session
+}
+
+func (s *quicSession) OpenStream() (Stream, error) {
+	stream, err := s.Session.OpenStreamSync()
+	if err != nil {
+		return nil, err
+	}
+	// the peer can't accept the stream until data are sent,
+	// so write one byte for prevent block
+	_ = stream.SetWriteDeadline(time.Now().Add(30 * time.Second))
+	_, err = stream.Write([]byte{0})
+	if err != nil {
+		stream.CancelRead(0)
+		_ = stream.Close()
+		return nil, err
+	}
+	_ = stream.SetWriteDeadline(time.Time{})
+	return &quicStream{Stream: stream, session: s}, nil
+}
+
+func (s *quicSession) AcceptStream() (Stream, error) {
+	stream, err := s.Session.AcceptStream()
+	if err != nil {
+		return nil, err
+	}
+	// read the byte written by OpenStream
+	_ = stream.SetReadDeadline(time.Now().Add(30 * time.Second))
+	first := make([]byte, 1)
+	_, err = io.ReadFull(stream, first)
+	if err != nil {
+		stream.CancelRead(0)
+		_ = stream.Close()
+		return nil, err
+	}
+	_ = stream.SetReadDeadline(time.Time{})
+	qs := quicStream{Stream: stream, session: s}
+	// the stream is not opened by OpenStream, such as an HTTP/3
+	// request, the byte is replayed for the fallback handler
+	if first[0] != 0 {
+		qs.prefix = first
+		qs.notOpened = true
+	}
+	return &qs, nil
+}
+
+func (s *quicSession) Done() <-chan struct{} {
+	return s.Session.Context().Done()
+}
+
+func (s *quicSession) Close() error {
+	err := s.Session.CloseWithError(0, "no error")
+	if s.rawConn != nil {
+		_ = s.rawConn.Close()
+	}
+	return err
+}
+
+type quicStream struct {
+	quic.Stream
+	session *quicSession
+
+	// the data read by AcceptStream that need be replayed
+	prefix    []byte
+	notOpened bool
+
+	// must use extra Mutex because SendStream
+	// is not safe for use by multiple goroutines
+	//
+	// stream.Close() must not be called concurrently with Write()
+	sendMutex sync.Mutex
+}
+
+func (s *quicStream) Read(b []byte) (int, error) {
+	if len(s.prefix) != 0 {
+		n := copy(b, s.prefix)
+		s.prefix = s.prefix[n:]
+		return n, nil
+	}
+	return s.Stream.Read(b)
+}
+
+// foreign is used to check the stream is not opened by OpenStream.
+func (s *quicStream) foreign() bool {
+	return s.notOpened
+}
+
+func (s *quicStream) Write(b []byte) (int, error) {
+	s.sendMutex.Lock()
+	defer s.sendMutex.Unlock()
+	return s.Stream.Write(b)
+}
+
+// Close is used to close both sides of the stream, the session is not closed.
+func (s *quicStream) Close() error {
+	s.Stream.CancelRead(0)
+	return s.CloseWrite()
+}
+
+func (s *quicStream) CloseWrite() error {
+	s.sendMutex.Lock()
+	defer s.sendMutex.Unlock()
+	return s.Stream.Close()
+}
+
+func (s *quicStream) CloseRead() error {
+	s.Stream.CancelRead(0)
+	return nil
+}
+
+func (s *quicStream) LocalAddr() net.Addr {
+	return s.session.LocalAddr()
+}
+
+func (s *quicStream) RemoteAddr() net.Addr {
+	return s.session.RemoteAddr()
+}
+
+type quicListener struct {
+	rawConn net.PacketConn // see quicSession
+	quic.Listener
+}
+
+func (l *quicListener) Accept() (Session, error) {
+	session, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &quicSession{Session: session}, nil
+}
+
+func (l *quicListener) Close() error {
+	err := l.Listener.Close()
+	_ = l.rawConn.Close()
+	return err
+}
@@ -0,0 +1,286 @@
+package socks
+
+import (
+	"crypto/tls"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var errOneStream = errors.New("the session only supports one stream")
+
+type tcpTransport struct {
+	// the session tickets about QUIC are not shared with TCP
+	sessionCache tls.ClientSessionCache
+
+	// dialer provides the local address and the control
+	// function about the TCP socket, it can be nil
+	dialer *net.Dialer
+}
+
+// NewTCPTransport is used to create the TLS 1.3 over TCP transport, it
+// is used when UDP is blocked, a session only carries one stream.
+func NewTCPTransport() Transport {
+	return &tcpTransport{sessionCache: tls.NewLRUClientSessionCache(32)}
+}
+
+// tcpTLSConfig is used to require TLS 1.3 and replace the ALPN about
+// QUIC, the HTTP/3 ALPN over TCP is an obvious fingerprint.
+func tcpTLSConfig(tlsConfig *tls.Config) *tls.Config {
+	tlsConfig = tlsConfig.Clone()
+	tlsConfig.MinVersion = tls.VersionTLS13
+	tlsConfig.NextProtos = []string{"h2", "http/1.1"}
+	return tlsConfig
+}
+
+func (t *tcpTransport) Dial(address string, tlsConfig *tls.Config) (Session, error) {
+	tlsConfig = tcpTLSConfig(tlsConfig)
+	tlsConfig.ClientSessionCache = t.sessionCache
+	dialer := net.Dialer{Timeout: 30 * time.Second}
+	if t.dialer != nil {
+		dialer.LocalAddr = t.dialer.LocalAddr
+		dialer.Control = t.dialer.Control
+	}
+	conn, err := tls.DialWithDialer(&dialer, "tcp", address, tlsConfig)
+	if err != nil {
+		return nil, err
+	}
+	return newSingleStreamSession(conn), nil
+}
+
+func (t *tcpTransport) Listen(address string, tlsConfig *tls.Config) (SessionListener, error) {
+	listener, err := tls.Listen("tcp", address, tcpTLSConfig(tlsConfig))
+	if err != nil {
+		return nil, err
+	}
+	return &tcpListener{Listener: listener}, nil
+}
+
+type tcpListener struct {
+	net.Listener
+}
+
+func (l *tcpListener) Accept() (Session, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return newSingleStreamSession(conn.(*tls.Conn)), nil
+}
+
+// singleStreamSession is the session that the stream is the connection.
+type singleStreamSession struct {
+	stream *singleStream
+
+	opened    bool
+	openedMu  sync.Mutex
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// newSingleStreamSession is used to create a session about the
+// connection, the connection must support CloseWrite.
+func newSingleStreamSession(conn net.Conn) *singleStreamSession {
+	s := singleStreamSession{done: make(chan struct{})}
+	s.stream = &singleStream{Conn: conn, session: &s}
+	return &s
+}
+
+// takeStream is used to get the stream, it can be only taken once.
+func (s *singleStreamSession) takeStream() (Stream, error) {
+	s.openedMu.Lock()
+	defer s.openedMu.Unlock()
+	if s.opened {
+		return nil, errOneStream
+	}
+	s.opened = true
+	return s.stream, nil
+}
+
+func (s *singleStreamSession) OpenStream() (Stream, error) {
+	return s.takeStream()
+}
+
+// AcceptStream returns the stream at the first call, the later
+// calls will block until the session is closed.
+func (s *singleStreamSession) AcceptStream() (Stream, error) {
+	stream, err := s.takeStream()
+	if err == nil {
+		return stream, nil
+	}
+	<-s.done
+	return nil, ErrConnClosed
+}
+
+func (s *singleStreamSession) Done() <-chan struct{} {
+	return s.done
+}
+
+func (s *singleStreamSession) setDone() {
+	s.closeOnce.Do(func() { close(s.done) })
+}
+
+func (s *singleStreamSession) LocalAddr() net.Addr {
+	return s.stream.Conn.LocalAddr()
+}
+
+func (s *singleStreamSession) RemoteAddr() net.Addr {
+	return s.stream.Conn.RemoteAddr()
+}
+
+func (s *singleStreamSession) Close() error {
+	s.setDone()
+	return s.stream.Conn.Close()
+}
+
+type singleStream struct {
+	net.Conn
+	session *singleStreamSession
+}
+
+// Read is used to read data, the session is done after the peer
+// closed the stream, because the session only carries it.
+func (s *singleStream) Read(b []byte) (int, error) {
+	n, err := s.Conn.Read(b)
+	if err != nil {
+		if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+			s.session.setDone()
+		}
+	}
+	return n, err
+}
+
+func (s *singleStream) Close() error {
+	return s.session.Close()
+}
+
+func (s *singleStream) CloseWrite() error {
+	return closeWrite(s.Conn)
+}
+
+// TCPFallbackOptions contains options about the TLS over TCP fallback,
+// it is used when UDP is blocked by the network.
+type TCPFallbackOptions struct {
+	// Address is the TLS over TCP address about the server
+	Address string
+
+	// HandshakeTimeout is the timeout about the QUIC handshake
+	// before fall back to TCP, default is 5 seconds
+	HandshakeTimeout time.Duration
+
+	// Remember is the duration about dial TCP directly on the same
+	// network after fall back, default is 10 minutes
+	Remember time.Duration
+}
+
+type tcpFallback struct {
+	address   string
+	transport Transport
+	remember  time.Duration
+
+	// key is the network, value is the expire time
+	networks   map[string]time.Time
+	networksMu sync.Mutex
+}
+
+// remembered is used to check the network has fallen back recently.
+func (f *tcpFallback) remembered(network string) bool {
+	f.networksMu.Lock()
+	defer f.networksMu.Unlock()
+	expire, ok := f.networks[network]
+	if !ok {
+		return false
+	}
+	if time.Now().After(expire) {
+		delete(f.networks, network)
+		return false
+	}
+	return true
+}
+
+func (f *tcpFallback) setRemember(network string) {
+	f.networksMu.Lock()
+	defer f.networksMu.Unlock()
+	f.networks[network] = time.Now().Add(f.remember)
+}
+
+// localNetwork is used to identify the network about the server, it is
+// the local IP address that the system routes to the server, a UDP dial
+// doesn't send any packets.
+func localNetwork(address string) string {
+	conn, err := net.Dial("udp", address)
+	if err != nil {
+		return ""
+	}
+	defer func() { _ = conn.Close() }()
+	host, _, _ := net.SplitHostPort(conn.LocalAddr().String())
+	return host
+}
+
+// SetTCPFallback is used to enable the TLS over TCP fallback, after the
+// QUIC handshake failed, the client will dial the server with TCP and
+// use TCP directly on the same network for a while, the server must
+// listen on TCP with ListenTCP, it must be called before Dial.
+func (c *Client) SetTCPFallback(opts *TCPFallbackOptions) {
+	transport := &tcpTransport{sessionCache: tls.NewLRUClientSessionCache(32)}
+	c.fallback = &tcpFallback{
+		address:   opts.Address,
+		transport: transport,
+		remember:  opts.Remember,
+		networks:  make(map[string]time.Time),
+	}
+	if c.fallback.remember <= 0 {
+		c.fallback.remember = 10 * time.Minute
+	}
+	// fall back quickly if UDP is blocked
+	if qt, ok := c.transport.(*quicTransport); ok {
+		timeout := opts.HandshakeTimeout
+		if timeout <= 0 {
+			timeout = 5 * time.Second
+		}
+		c.transport = &quicTransport{handshakeTimeout: timeout, dialer: qt.dialer}
+		transport.dialer = qt.dialer
+	}
+}
+
+// dial is used to dial the server with the transport,
+// or TCP if the fallback is enabled and UDP is blocked.
+func (c *Client) dial() (*Conn, error) {
+	if c.fallback == nil {
+		return dialConn(c.transport, c.address, c.tlsConfig)
+	}
+	network := localNetwork(c.address)
+	if c.fallback.remembered(network) {
+		return dialConn(c.fallback.transport, c.fallback.address, c.tlsConfig)
+	}
+	conn, err := dialConn(c.transport, c.address, c.tlsConfig)
+	if err == nil {
+		return conn, nil
+	}
+	conn, tcpErr := dialConn(c.fallback.transport, c.fallback.address, c.tlsConfig)
+	if tcpErr != nil {
+		return nil, errors.WithMessagef(tcpErr, "failed to fall back to TCP after %s", err)
+	}
+	c.fallback.setRemember(network)
+	return conn, nil
+}
+
+// ListenTCP is used to also listen on TCP with TLS 1.3 for the clients
+// that UDP is blocked, the protocol is the same as QUIC, the connection
+// is not multiplexed, it must be called before ListenAndServe.
+func (s *Server) ListenTCP(address string) error {
+	addr, err := s.Listen(NewTCPTransport(), address)
+	if err != nil {
+		return err
+	}
+	s.tcpAddr = addr
+	return nil
+}
+
+// TCPAddr is used to get the TLS over TCP listener
+// address, it is nil if ListenTCP is not called.
+func (s *Server) TCPAddr() net.Addr {
+	return s.tcpAddr
+}
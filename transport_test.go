@@ -0,0 +1,224 @@
+package socks
+
+import (
+	"crypto/tls"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// testMemTransport is the in-memory transport, the TLS config is ignored.
+type testMemTransport struct {
+	sessions chan *testMemSession
+	closed   chan struct{}
+	once     sync.Once
+}
+
+func newTestMemTransport() *testMemTransport {
+	return &testMemTransport{
+		sessions: make(chan *testMemSession),
+		closed:   make(chan struct{}),
+	}
+}
+
+func (t *testMemTransport) Dial(string, *tls.Config) (Session, error) {
+	client, server := newTestMemSessionPair()
+	select {
+	case t.sessions <- server:
+		return client, nil
+	case <-t.closed:
+		return nil, ErrConnClosed
+	}
+}
+
+func (t *testMemTransport) Listen(string, *tls.Config) (SessionListener, error) {
+	return t, nil
+}
+
+func (t *testMemTransport) Accept() (Session, error) {
+	select {
+	case session := <-t.sessions:
+		return session, nil
+	case <-t.closed:
+		return nil, ErrConnClosed
+	}
+}
+
+func (t *testMemTransport) Addr() net.Addr {
+	return testMemAddr{}
+}
+
+func (t *testMemTransport) Close() error {
+	t.once.Do(func() { close(t.closed) })
+	return nil
+}
+
+type testMemAddr struct{}
+
+func (testMemAddr) Network() string { return "memory" }
+func (testMemAddr) String() string  { return "memory" }
+
+type testMemSession struct {
+	peer    *testMemSession
+	streams chan Stream
+	done    chan struct{}
+	once    *sync.Once // shared with the peer
+}
+
+func newTestMemSessionPair() (*testMemSession, *testMemSession) {
+	done := make(chan struct{})
+	once := new(sync.Once)
+	a := testMemSession{streams: make(chan Stream, 16), done: done, once: once}
+	b := testMemSession{streams: make(chan Stream, 16), done: done, once: once}
+	a.peer, b.peer = &b, &a
+	return &a, &b
+}
+
+func (s *testMemSession) OpenStream() (Stream, error) {
+	// one net.Pipe per direction for support CloseWrite
+	r1, w1 := net.Pipe()
+	r2, w2 := net.Pipe()
+	select {
+	case s.peer.streams <- newTestMemStream(r2, w1):
+		return newTestMemStream(r1, w2), nil
+	case <-s.done:
+		return nil, ErrConnClosed
+	}
+}
+
+func (s *testMemSession) AcceptStream() (Stream, error) {
+	select {
+	case stream := <-s.streams:
+		return stream, nil
+	case <-s.done:
+		return nil, ErrConnClosed
+	}
+}
+
+func (s *testMemSession) Done() <-chan struct{} { return s.done }
+func (s *testMemSession) LocalAddr() net.Addr   { return testMemAddr{} }
+func (s *testMemSession) RemoteAddr() net.Addr  { return testMemAddr{} }
+
+func (s *testMemSession) Close() error {
+	s.once.Do(func() { close(s.done) })
+	return nil
+}
+
+// testMemStream is the stream with buffered writes like a QUIC stream,
+// net.Pipe is synchronous, a pipelined request written by one Write
+// will be blocked if the server replies before it read all data.
+type testMemStream struct {
+	r net.Conn // read end of a pipe
+	w net.Conn // write end of another pipe
+
+	queue  chan []byte
+	closed bool
+	mu     sync.Mutex
+}
+
+func newTestMemStream(r, w net.Conn) *testMemStream {
+	s := testMemStream{r: r, w: w, queue: make(chan []byte, 1024)}
+	go func() {
+		for b := range s.queue {
+			_, err := w.Write(b)
+			if err != nil {
+				break
+			}
+		}
+		_ = w.Close()
+	}()
+	return &s
+}
+
+func (s *testMemStream) Read(b []byte) (int, error) { return s.r.Read(b) }
+func (s *testMemStream) LocalAddr() net.Addr        { return testMemAddr{} }
+func (s *testMemStream) RemoteAddr() net.Addr       { return testMemAddr{} }
+
+func (s *testMemStream) Write(b []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return 0, io.ErrClosedPipe
+	}
+	s.queue <- append([]byte(nil), b...)
+	return len(b), nil
+}
+
+// CloseWrite is used to close the write end after the queued data are written.
+func (s *testMemStream) CloseWrite() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.closed {
+		s.closed = true
+		close(s.queue)
+	}
+	return nil
+}
+
+func (s *testMemStream) Close() error {
+	_ = s.CloseWrite()
+	_ = s.r.Close()
+	return s.w.Close()
+}
+
+func (s *testMemStream) SetDeadline(t time.Time) error {
+	_ = s.r.SetReadDeadline(t)
+	return s.w.SetWriteDeadline(t)
+}
+
+func (s *testMemStream) SetReadDeadline(t time.Time) error  { return s.r.SetReadDeadline(t) }
+func (s *testMemStream) SetWriteDeadline(t time.Time) error { return s.w.SetWriteDeadline(t) }
+
+func TestTransport(t *testing.T) {
+	echo := testListen(t, testEcho)
+	defer func() { _ = echo.Close() }()
+	transport := newTestMemTransport()
+	server, err := NewServerWithTransport(transport, "", []byte("test"), new(tls.Config))
+	require.NoError(t, err)
+	defer server.Close()
+	go func() { _ = server.ListenAndServe() }()
+	client, err := NewClientWithTransport(transport, "", []byte("test"), new(tls.Config))
+	require.NoError(t, err)
+
+	host, port := splitTarget(t, echo.Addr().String())
+	t.Run("DialConnect", func(t *testing.T) {
+		conn, err := client.DialConnect(host, port, []byte("hello"))
+		require.NoError(t, err)
+		defer func() { _ = conn.Close() }()
+		require.NoError(t, conn.(*Conn).CloseWrite())
+		b, err := ioutil.ReadAll(conn)
+		require.NoError(t, err)
+		require.Equal(t, "hello", string(b))
+	})
+
+	t.Run("Connect", func(t *testing.T) {
+		conn, err := client.Dial()
+		require.NoError(t, err)
+		conn, err = Connect(conn, host, port)
+		require.NoError(t, err)
+		defer func() { _ = conn.Close() }()
+		_, err = conn.Write([]byte("hello"))
+		require.NoError(t, err)
+		buf := make([]byte, 5)
+		_, err = io.ReadFull(conn, buf)
+		require.NoError(t, err)
+		require.Equal(t, "hello", string(buf))
+	})
+
+	t.Run("invalid password", func(t *testing.T) {
+		client, err := NewClientWithTransport(transport, "", []byte("foo"), new(tls.Config))
+		require.NoError(t, err)
+		conn, err := client.dial()
+		require.NoError(t, err)
+		defer func() { _ = conn.Close() }()
+		go func() { _, _ = conn.Write(client.authData()) }()
+		_ = conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		_, err = conn.Read(make([]byte, 1))
+		require.Error(t, err)
+	})
+}
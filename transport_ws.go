@@ -0,0 +1,502 @@
+package socks
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// WebSocketOptions contains options about the WebSocket transport.
+type WebSocketOptions struct {
+	// Path is the HTTP path about the WebSocket, default is "/"
+	Path string
+
+	// Host is the Host header sent by the client, default is the
+	// host about the address, it is useful for the CDN
+	Host string
+
+	// Plain is used to dial or listen without TLS, the server behind
+	// the reverse proxy that terminates TLS can listen with it
+	Plain bool
+}
+
+type wsTransport struct {
+	path  string
+	host  string
+	plain bool
+}
+
+// NewWebSocketTransport is used to create the WebSocket(RFC 6455)
+// transport, the server is an ordinary HTTP server, so it can be
+// deployed behind the HTTP reverse proxy or the CDN, a session only
+// carries one stream, opts can be nil.
+func NewWebSocketTransport(opts *WebSocketOptions) Transport {
+	if opts == nil {
+		opts = new(WebSocketOptions)
+	}
+	t := wsTransport{
+		path:  opts.Path,
+		host:  opts.Host,
+		plain: opts.Plain,
+	}
+	if t.path == "" {
+		t.path = "/"
+	}
+	return &t
+}
+
+const wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// wsAccept is used to calculate the Sec-WebSocket-Accept about the key.
+func wsAccept(key string) string {
+	h := sha1.Sum([]byte(key + wsGUID))
+	return base64.StdEncoding.EncodeToString(h[:])
+}
+
+// wsTLSConfig is used to replace the ALPN about QUIC, the
+// unknown protocol may be rejected by the reverse proxy.
+func wsTLSConfig(tlsConfig *tls.Config) *tls.Config {
+	tlsConfig = tlsConfig.Clone()
+	tlsConfig.NextProtos = []string{"http/1.1"}
+	return tlsConfig
+}
+
+func (t *wsTransport) Dial(address string, tlsConfig *tls.Config) (Session, error) {
+	dialer := net.Dialer{Timeout: 30 * time.Second}
+	conn, err := dialer.Dial("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	var success bool
+	defer func() {
+		if !success {
+			_ = conn.Close()
+		}
+	}()
+	_ = conn.SetDeadline(time.Now().Add(30 * time.Second))
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	if !t.plain {
+		tlsConfig = wsTLSConfig(tlsConfig)
+		if tlsConfig.ServerName == "" {
+			tlsConfig.ServerName = host
+		}
+		conn = tls.Client(conn, tlsConfig)
+	}
+	b := make([]byte, 16)
+	_, err = rand.Read(b)
+	if err != nil {
+		return nil, err
+	}
+	key := base64.StdEncoding.EncodeToString(b)
+	req := http.Request{
+		Method: http.MethodGet,
+		URL:    &url.URL{Path: t.path},
+		Host:   t.host,
+		Header: http.Header{
+			"Upgrade":               {"websocket"},
+			"Connection":            {"Upgrade"},
+			"Sec-WebSocket-Key":     {key},
+			"Sec-WebSocket-Version": {"13"},
+		},
+	}
+	if req.Host == "" {
+		req.Host = address
+	}
+	err = req.Write(conn)
+	if err != nil {
+		return nil, err
+	}
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, &req)
+	if err != nil {
+		return nil, err
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusSwitchingProtocols ||
+		resp.Header.Get("Sec-WebSocket-Accept") != wsAccept(key) {
+		return nil, errors.Errorf("unexpected WebSocket handshake response: %s", resp.Status)
+	}
+	_ = conn.SetDeadline(time.Time{})
+	success = true
+	return newSingleStreamSession(newWSConn(conn, r, true)), nil
+}
+
+func (t *wsTransport) Listen(address string, tlsConfig *tls.Config) (SessionListener, error) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	l := wsListener{
+		Listener: listener,
+		path:     t.path,
+		sessions: make(chan Session),
+		closed:   make(chan struct{}),
+	}
+	if !t.plain {
+		l.Listener = tls.NewListener(listener, wsTLSConfig(tlsConfig))
+	}
+	l.server = &http.Server{
+		Handler:           &l,
+		ReadHeaderTimeout: 30 * time.Second,
+	}
+	go func() { _ = l.server.Serve(l.Listener) }()
+	return &l, nil
+}
+
+// wsListener is an HTTP server that upgrades the requests about
+// the path to WebSocket, the other requests are replied 404.
+type wsListener struct {
+	net.Listener
+	path     string
+	server   *http.Server
+	sessions chan Session
+
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func (l *wsListener) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if r.Method != http.MethodGet || r.URL.Path != l.path || key == "" ||
+		!headerContains(r.Header, "Connection", "upgrade") ||
+		!headerContains(r.Header, "Upgrade", "websocket") ||
+		r.Header.Get("Sec-WebSocket-Version") != "13" {
+		http.NotFound(w, r)
+		return
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return
+	}
+	_ = conn.SetDeadline(time.Now().Add(30 * time.Second))
+	_, err = conn.Write([]byte("HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\nConnection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + wsAccept(key) + "\r\n\r\n"))
+	if err != nil {
+		_ = conn.Close()
+		return
+	}
+	_ = conn.SetDeadline(time.Time{})
+	session := newSingleStreamSession(newWSConn(conn, rw.Reader, false))
+	select {
+	case l.sessions <- session:
+	case <-l.closed:
+		_ = conn.Close()
+	}
+}
+
+// headerContains is used to check the comma-separated header
+// contains the token, it is case-insensitive.
+func headerContains(header http.Header, name, token string) bool {
+	for _, value := range header[http.CanonicalHeaderKey(name)] {
+		for _, v := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(v), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (l *wsListener) Accept() (Session, error) {
+	select {
+	case session := <-l.sessions:
+		return session, nil
+	case <-l.closed:
+		return nil, ErrConnClosed
+	}
+}
+
+func (l *wsListener) Close() error {
+	l.closeOnce.Do(func() { close(l.closed) })
+	return l.server.Close()
+}
+
+// opcodes about WebSocket frame.
+const (
+	wsContinuation uint8 = 0x0
+	wsText         uint8 = 0x1
+	wsBinary       uint8 = 0x2
+	wsClose        uint8 = 0x8
+	wsPing         uint8 = 0x9
+	wsPong         uint8 = 0xA
+)
+
+var errInvalidWSFrame = errors.New("invalid WebSocket frame")
+
+// wsPingInterval is the interval about the keepalive ping, the
+// reverse proxy and the CDN close the idle WebSocket connection.
+var wsPingInterval = 30 * time.Second
+
+// wsConn is the byte stream over WebSocket binary frames. The empty
+// binary frame is used as the half close, so CloseWrite sends it and
+// Read returns io.EOF after received it, the close frame is only used
+// to close the connection, it is replied like RFC 6455 required.
+type wsConn struct {
+	net.Conn
+	r      *bufio.Reader
+	client bool // the client must mask the frames
+
+	// read state about the current data frame
+	remain  uint64
+	mask    [4]byte
+	maskPos int
+	masked  bool
+	readErr error
+	readMu  sync.Mutex
+
+	writeClosed bool // sent the empty binary frame
+	closeSent   bool // sent the close frame
+	writeMu     sync.Mutex
+
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func newWSConn(conn net.Conn, r *bufio.Reader, client bool) *wsConn {
+	c := wsConn{
+		Conn:   conn,
+		r:      r,
+		client: client,
+		closed: make(chan struct{}),
+	}
+	go c.keepalive(wsPingInterval)
+	return &c
+}
+
+// keepalive is used to send ping periodically until the conn is closed.
+func (c *wsConn) keepalive(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if c.writeFrame(wsPing, nil) != nil {
+				return
+			}
+		case <-c.closed:
+			return
+		}
+	}
+}
+
+func (c *wsConn) Read(b []byte) (int, error) {
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+	for c.remain == 0 {
+		if c.readErr != nil {
+			return 0, c.readErr
+		}
+		err := c.readHeader()
+		if err != nil {
+			return 0, err
+		}
+	}
+	if uint64(len(b)) > c.remain {
+		b = b[:c.remain]
+	}
+	n, err := c.r.Read(b)
+	if c.masked {
+		for i := 0; i < n; i++ {
+			b[i] ^= c.mask[c.maskPos&3]
+			c.maskPos++
+		}
+	}
+	c.remain -= uint64(n)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// readHeader is used to read the frame header, the control frames are
+// handled, the error is kept if the header is broken or the peer closed.
+func (c *wsConn) readHeader() error {
+	header := make([]byte, 2)
+	n, err := io.ReadFull(c.r, header)
+	if err != nil {
+		if ne, ok := err.(net.Error); ok && ne.Timeout() && n == 0 {
+			return err
+		}
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		c.readErr = err
+		return err
+	}
+	c.readErr = c.readFrame(header)
+	return c.readErr
+}
+
+func (c *wsConn) readFrame(header []byte) error {
+	fin := header[0]&0x80 != 0
+	opcode := header[0] & 0x0F
+	masked := header[1]&0x80 != 0
+	// the frames from the client must be masked, and the
+	// frames from the server must not be masked
+	if masked == c.client {
+		return errInvalidWSFrame
+	}
+	length := uint64(header[1] & 0x7F)
+	switch length {
+	case 126:
+		buf := make([]byte, 2)
+		_, err := io.ReadFull(c.r, buf)
+		if err != nil {
+			return err
+		}
+		length = uint64(binary.BigEndian.Uint16(buf))
+	case 127:
+		buf := make([]byte, 8)
+		_, err := io.ReadFull(c.r, buf)
+		if err != nil {
+			return err
+		}
+		length = binary.BigEndian.Uint64(buf)
+	}
+	if masked {
+		_, err := io.ReadFull(c.r, c.mask[:])
+		if err != nil {
+			return err
+		}
+	}
+	switch opcode {
+	case wsBinary:
+		// the empty binary frame is the half close
+		if fin && length == 0 {
+			return io.EOF
+		}
+		fallthrough
+	case wsContinuation, wsText:
+		c.remain = length
+		c.maskPos = 0
+		c.masked = masked
+		return nil
+	case wsClose, wsPing, wsPong:
+	default:
+		return errInvalidWSFrame
+	}
+	if length > 125 {
+		return errInvalidWSFrame
+	}
+	payload := make([]byte, length)
+	_, err := io.ReadFull(c.r, payload)
+	if err != nil {
+		return err
+	}
+	if masked {
+		for i := 0; i < len(payload); i++ {
+			payload[i] ^= c.mask[i&3]
+		}
+	}
+	switch opcode {
+	case wsClose:
+		// reply the close frame with the status code
+		if len(payload) > 2 {
+			payload = payload[:2]
+		}
+		// the peer may close the connection after sent it
+		_ = c.writeFrame(wsClose, payload)
+		return io.EOF
+	case wsPing:
+		err = c.writeFrame(wsPong, payload)
+		if err == errWriteClosed {
+			err = nil
+		}
+		return err
+	default: // pong
+		return nil
+	}
+}
+
+var errWriteClosed = errors.New("WebSocket write side is closed")
+
+func (c *wsConn) Write(b []byte) (int, error) {
+	// the empty binary frame is the half close
+	if len(b) == 0 {
+		return 0, nil
+	}
+	err := c.writeFrame(wsBinary, b)
+	if err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *wsConn) writeFrame(opcode uint8, payload []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if c.closeSent || (opcode == wsBinary && c.writeClosed) {
+		return errWriteClosed
+	}
+	switch opcode {
+	case wsBinary:
+		c.writeClosed = len(payload) == 0
+	case wsClose:
+		c.closeSent = true
+	}
+	frame := make([]byte, 2, 14+len(payload))
+	frame[0] = 0x80 | opcode // FIN
+	switch l := len(payload); {
+	case l <= 125:
+		frame[1] = byte(l)
+	case l <= 65535:
+		frame[1] = 126
+		frame = append(frame, byte(l>>8), byte(l))
+	default:
+		frame[1] = 127
+		frame = append(frame, make([]byte, 8)...)
+		binary.BigEndian.PutUint64(frame[len(frame)-8:], uint64(l))
+	}
+	if !c.client {
+		_, err := c.Conn.Write(append(frame, payload...))
+		return err
+	}
+	frame[1] |= 0x80
+	mask := make([]byte, 4)
+	_, err := rand.Read(mask)
+	if err != nil {
+		return err
+	}
+	frame = append(frame, mask...)
+	for i := 0; i < len(payload); i++ {
+		frame = append(frame, payload[i]^mask[i&3])
+	}
+	_, err = c.Conn.Write(frame)
+	return err
+}
+
+// CloseWrite is used to send the empty binary frame, the peer
+// can still send data, the ping and pong are still sent.
+func (c *wsConn) CloseWrite() error {
+	return c.writeFrame(wsBinary, nil)
+}
+
+// Close is used to send the close frame with status 1000 and close the
+// connection, the blocked write is interrupted by the write deadline.
+func (c *wsConn) Close() error {
+	c.closeOnce.Do(func() { close(c.closed) })
+	_ = c.Conn.SetWriteDeadline(time.Now().Add(time.Second))
+	_ = c.writeFrame(wsClose, []byte{0x03, 0xE8})
+	return c.Conn.Close()
+}
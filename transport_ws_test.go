@@ -0,0 +1,161 @@
+package socks
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// testWebSocketEcho is used to send data with half close
+// through the echo server and check the echoed data.
+func testWebSocketEcho(t *testing.T, client *Client, target string) {
+	host, port := splitTarget(t, target)
+	// larger than 64 KiB for test the 64-bit payload length
+	data := make([]byte, 1024*1024)
+	_, err := rand.Read(data)
+	require.NoError(t, err)
+	conn, err := client.DialConnect(host, port, data)
+	require.NoError(t, err)
+	defer func() { _ = conn.Close() }()
+	require.NoError(t, conn.(*Conn).CloseWrite())
+	_ = conn.SetReadDeadline(time.Now().Add(30 * time.Second))
+	received, err := ioutil.ReadAll(conn)
+	require.NoError(t, err)
+	require.True(t, bytes.Equal(data, received))
+}
+
+func TestWebSocketTransport(t *testing.T) {
+	echo := testListen(t, testEcho)
+	defer func() { _ = echo.Close() }()
+
+	t.Run("tls", func(t *testing.T) {
+		transport := NewWebSocketTransport(&WebSocketOptions{Path: "/ws"})
+		server, err := NewServerWithTransport(transport, "localhost:0", []byte("test"), testServerTLS(t))
+		require.NoError(t, err)
+		defer server.Close()
+		go func() { _ = server.ListenAndServe() }()
+
+		client, err := NewClientWithTransport(transport, server.Addr().String(), []byte("test"), testClientTLS(t))
+		require.NoError(t, err)
+		testWebSocketEcho(t, client, echo.Addr().String())
+	})
+
+	t.Run("reverse proxy", func(t *testing.T) {
+		// the proxy terminates TLS and forwards HTTP to the server
+		transport := NewWebSocketTransport(&WebSocketOptions{Path: "/ws", Plain: true})
+		server, err := NewServerWithTransport(transport, "localhost:0", []byte("test"), testServerTLS(t))
+		require.NoError(t, err)
+		defer server.Close()
+		go func() { _ = server.ListenAndServe() }()
+		proxy := httptest.NewServer(httputil.NewSingleHostReverseProxy(&url.URL{
+			Scheme: "http",
+			Host:   server.Addr().String(),
+		}))
+		defer proxy.Close()
+
+		proxyURL, err := url.Parse(proxy.URL)
+		require.NoError(t, err)
+		client, err := NewClientWithTransport(transport, proxyURL.Host, []byte("test"), testClientTLS(t))
+		require.NoError(t, err)
+		testWebSocketEcho(t, client, echo.Addr().String())
+
+		// the other requests are replied like an ordinary HTTP server
+		resp, err := http.Get(proxy.URL + "/ws")
+		require.NoError(t, err)
+		_ = resp.Body.Close()
+		require.Equal(t, http.StatusNotFound, resp.StatusCode)
+	})
+
+	t.Run("invalid path", func(t *testing.T) {
+		transport := NewWebSocketTransport(&WebSocketOptions{Path: "/ws", Plain: true})
+		server, err := NewServerWithTransport(transport, "localhost:0", []byte("test"), testServerTLS(t))
+		require.NoError(t, err)
+		defer server.Close()
+		go func() { _ = server.ListenAndServe() }()
+
+		transport = NewWebSocketTransport(&WebSocketOptions{Path: "/foo", Plain: true})
+		client, err := NewClientWithTransport(transport, server.Addr().String(), []byte("test"), testClientTLS(t))
+		require.NoError(t, err)
+		_, err = client.Dial()
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "404")
+	})
+}
+
+func TestWSConn(t *testing.T) {
+	t.Run("half close", func(t *testing.T) {
+		c, s := testTCPPair(t)
+		client := newWSConn(c, bufio.NewReader(c), true)
+		server := newWSConn(s, bufio.NewReader(s), false)
+		defer func() { _ = client.Close() }()
+		defer func() { _ = server.Close() }()
+
+		_, err := client.Write([]byte("hello"))
+		require.NoError(t, err)
+		require.NoError(t, client.CloseWrite())
+		_, err = client.Write([]byte("hello"))
+		require.Equal(t, errWriteClosed, err)
+		b, err := ioutil.ReadAll(server)
+		require.NoError(t, err)
+		require.Equal(t, "hello", string(b))
+
+		// the other direction is still available
+		_, err = server.Write([]byte("world"))
+		require.NoError(t, err)
+		require.NoError(t, server.CloseWrite())
+		b, err = ioutil.ReadAll(client)
+		require.NoError(t, err)
+		require.Equal(t, "world", string(b))
+	})
+
+	t.Run("close", func(t *testing.T) {
+		c, s := testTCPPair(t)
+		client := newWSConn(c, bufio.NewReader(c), true)
+		defer func() { _ = client.Close() }()
+		defer func() { _ = s.Close() }()
+
+		// the close frame from the server with status 1001
+		_, err := s.Write([]byte{0x88, 0x02, 0x03, 0xE9})
+		require.NoError(t, err)
+		_, err = client.Read(make([]byte, 1))
+		require.Equal(t, io.EOF, err)
+
+		// the reply is masked with the same status
+		frame := make([]byte, 8)
+		_, err = io.ReadFull(s, frame)
+		require.NoError(t, err)
+		require.Equal(t, []byte{0x88, 0x82}, frame[:2])
+		status := []byte{frame[6] ^ frame[2], frame[7] ^ frame[3]}
+		require.Equal(t, []byte{0x03, 0xE9}, status)
+		_, err = client.Write([]byte("hello"))
+		require.Equal(t, errWriteClosed, err)
+	})
+
+	t.Run("keepalive", func(t *testing.T) {
+		interval := wsPingInterval
+		wsPingInterval = 50 * time.Millisecond
+		defer func() { wsPingInterval = interval }()
+		c, s := testTCPPair(t)
+		client := newWSConn(c, bufio.NewReader(c), true)
+		defer func() { _ = client.Close() }()
+		defer func() { _ = s.Close() }()
+
+		_ = s.SetReadDeadline(time.Now().Add(5 * time.Second))
+		for i := 0; i < 2; i++ {
+			frame := make([]byte, 6)
+			_, err := io.ReadFull(s, frame)
+			require.NoError(t, err)
+			require.Equal(t, []byte{0x89, 0x80}, frame[:2])
+		}
+	})
+}
@@ -0,0 +1,235 @@
+package socks
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// testListen is used to start a TCP server on a random loopback port.
+func testListen(t *testing.T, handler func(conn net.Conn)) net.Listener {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer func() { _ = conn.Close() }()
+				handler(conn)
+			}()
+		}
+	}()
+	return listener
+}
+
+func testEcho(conn net.Conn) {
+	_, _ = io.Copy(conn, conn)
+}
+
+func testPipe(a, b net.Conn) {
+	go func() { _, _ = io.Copy(a, b) }()
+	_, _ = io.Copy(b, a)
+}
+
+func testProxyEcho(t *testing.T, p proxyDialer, target string) {
+	host, port := splitTarget(t, target)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	conn, err := p.Dial(ctx, host, port)
+	require.NoError(t, err)
+	defer func() { _ = conn.Close() }()
+	_, err = conn.Write([]byte("hello"))
+	require.NoError(t, err)
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(conn, buf)
+	require.NoError(t, err)
+	require.Equal(t, "hello", string(buf))
+}
+
+func TestSOCKS5Proxy(t *testing.T) {
+	echo := testListen(t, testEcho)
+	defer func() { _ = echo.Close() }()
+	proxy := testListen(t, func(conn net.Conn) {
+		buf := make([]byte, 262)
+		// methods
+		_, _ = io.ReadFull(conn, buf[:2])
+		_, _ = io.ReadFull(conn, buf[:buf[1]])
+		_, _ = conn.Write([]byte{0x05, 0x02})
+		// username and password
+		_, _ = io.ReadFull(conn, buf[:2])
+		_, _ = io.ReadFull(conn, buf[:buf[1]])
+		username := string(buf[:len("user")])
+		_, _ = io.ReadFull(conn, buf[:1])
+		_, _ = io.ReadFull(conn, buf[:buf[0]])
+		password := string(buf[:len("pass")])
+		if username != "user" || password != "pass" {
+			_, _ = conn.Write([]byte{0x01, 0x01})
+			return
+		}
+		_, _ = conn.Write([]byte{0x01, 0x00})
+		// connect IPv4
+		_, _ = io.ReadFull(conn, buf[:10])
+		ip := net.IP(buf[4:8])
+		port := binary.BigEndian.Uint16(buf[8:10])
+		remote, err := net.Dial("tcp", (&net.TCPAddr{IP: ip, Port: int(port)}).String())
+		if err != nil {
+			return
+		}
+		defer func() { _ = remote.Close() }()
+		_, _ = conn.Write([]byte{0x05, 0x00, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
+		testPipe(conn, remote)
+	})
+	defer func() { _ = proxy.Close() }()
+	u, err := url.Parse("socks5://user:pass@" + proxy.Addr().String())
+	require.NoError(t, err)
+	testProxyEcho(t, newSOCKS5Proxy(u, new(net.Dialer)), echo.Addr().String())
+}
+
+func TestHTTPProxy(t *testing.T) {
+	echo := testListen(t, testEcho)
+	defer func() { _ = echo.Close() }()
+	proxy := testListen(t, func(conn net.Conn) {
+		br := bufio.NewReader(conn)
+		req, err := http.ReadRequest(br)
+		if err != nil {
+			return
+		}
+		if req.Method != http.MethodConnect ||
+			req.Header.Get("Proxy-Authorization") != "Basic dXNlcjpwYXNz" {
+			_, _ = conn.Write([]byte("HTTP/1.1 407 Proxy Authentication Required\r\n\r\n"))
+			return
+		}
+		remote, err := net.Dial("tcp", req.Host)
+		if err != nil {
+			return
+		}
+		defer func() { _ = remote.Close() }()
+		_, _ = conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+		testPipe(conn, remote)
+	})
+	defer func() { _ = proxy.Close() }()
+	u, err := url.Parse("http://user:pass@" + proxy.Addr().String())
+	require.NoError(t, err)
+	testProxyEcho(t, newHTTPProxy(u, new(net.Dialer)), echo.Addr().String())
+
+	// invalid password
+	u, err = url.Parse("http://user:foo@" + proxy.Addr().String())
+	require.NoError(t, err)
+	host, port := splitTarget(t, echo.Addr().String())
+	_, err = newHTTPProxy(u, new(net.Dialer)).Dial(context.Background(), host, port)
+	require.Error(t, err)
+}
+
+func TestQUICSocksProxy(t *testing.T) {
+	echo := testListen(t, testEcho)
+	defer func() { _ = echo.Close() }()
+	server, _ := testServer(t)
+	defer server.Close()
+	u, err := url.Parse("quic-socks://test@" + server.Addr().String() + "?sni=localhost&ca=testdata/cert.pem")
+	require.NoError(t, err)
+	// the local address and the control function are applied
+	var controlled int32
+	d := net.Dialer{
+		LocalAddr: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)},
+		Control: func(network, _ string, _ syscall.RawConn) error {
+			if network == "udp4" {
+				atomic.AddInt32(&controlled, 1)
+			}
+			return nil
+		},
+	}
+	proxy, err := newQUICSocksProxy(u, &d)
+	require.NoError(t, err)
+	testProxyEcho(t, proxy, echo.Addr().String())
+	require.Equal(t, int32(1), atomic.LoadInt32(&controlled))
+
+	// the server doesn't reply the handshake
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer func() { _ = conn.Close() }()
+	u, err = url.Parse("quic-socks://test@" + conn.LocalAddr().String() + "?insecure=1")
+	require.NoError(t, err)
+	proxy, err = newQUICSocksProxy(u, new(net.Dialer))
+	require.NoError(t, err)
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	host, port := splitTarget(t, echo.Addr().String())
+	start := time.Now()
+	_, err = proxy.Dial(ctx, host, port)
+	require.Error(t, err)
+	require.Less(t, int64(time.Since(start)), int64(5*time.Second))
+}
+
+func TestDialer_Routes(t *testing.T) {
+	d, err := newDialer(&DialOptions{Routes: []*Route{
+		{Hosts: []string{"127.0.0.1"}, Proxy: "direct"},
+		{Proxy: "socks5://127.0.0.1:1"},
+	}})
+	require.NoError(t, err)
+	require.Len(t, d.routes, 2)
+	require.Nil(t, d.routes[0].proxy)
+	require.True(t, d.routes[1].match("example.com", 80))
+
+	_, err = newDialer(&DialOptions{Routes: []*Route{{Proxy: "ftp://127.0.0.1"}}})
+	require.Error(t, err)
+}
+
+// testRecordProxy is the upstream proxy that records the targets.
+type testRecordProxy struct {
+	targets []string
+}
+
+func (p *testRecordProxy) Dial(_ context.Context, host string, port uint16) (net.Conn, error) {
+	p.targets = append(p.targets, net.JoinHostPort(host, strconv.Itoa(int(port))))
+	conn, _ := net.Pipe()
+	return conn, nil
+}
+
+func TestDialer_RoutesACL(t *testing.T) {
+	resolver, err := NewResolver(&ResolverOptions{Hosts: map[string][]string{
+		"internal.com": {"10.0.0.1"},
+		"public.com":   {"1.1.1.1"},
+	}})
+	require.NoError(t, err)
+	d, err := newDialer(&DialOptions{
+		Resolver: resolver,
+		Routes:   []*Route{{Proxy: "socks5://127.0.0.1:1"}},
+	})
+	require.NoError(t, err)
+	proxy := new(testRecordProxy)
+	d.routes[0].proxy = proxy
+
+	a, err := (&ACL{Deny: []string{"10.0.0.0/8"}}).compile()
+	require.NoError(t, err)
+	_, err = d.Dial("internal.com:80", a)
+	require.Equal(t, ErrNotAllowed, err)
+	_, err = d.Dial("10.0.0.1:80", a)
+	require.Equal(t, ErrNotAllowed, err)
+	conn, err := d.Dial("public.com:80", a)
+	require.NoError(t, err)
+	_ = conn.Close()
+	// the proxy connects the checked IP address
+	require.Equal(t, []string{"1.1.1.1:80"}, proxy.targets)
+
+	// the FQDN is sent to the proxy if the acl has no IP rules
+	a, err = (&ACL{Deny: []string{"*.internal"}}).compile()
+	require.NoError(t, err)
+	conn, err = d.Dial("internal.com:80", a)
+	require.NoError(t, err)
+	_ = conn.Close()
+	require.Equal(t, "internal.com:80", proxy.targets[1])
+}